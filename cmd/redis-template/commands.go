@@ -0,0 +1,928 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/robbert229/redis-template/pkg"
+)
+
+// commands are the subcommands of redis-template, by name. Each is given the arguments following its name and returns
+// the exit code.
+var commands = map[string]func(args []string) int{
+	"set":      runSet,
+	"del":      runDel,
+	"hset":     runHSet,
+	"publish":  runPublish,
+	"import":   runImport,
+	"export":   runExport,
+	"lint":     runLint,
+	"diff":     runDiff,
+	"status":   runStatus,
+	"rollout":  runRollout,
+	"history":  runHistory,
+	"rollback": runRollback,
+	"encrypt":  runEncrypt,
+}
+
+// redisFlags are the flags shared by the subcommands that connect to redis.
+type redisFlags struct {
+	addr    string
+	channel string
+}
+
+// register adds the flags to the flag set.
+func (f *redisFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.addr, "redis-addr", "", "the redis connection string")
+	fs.StringVar(&f.channel, "redis-chan", pkg.RedisTemplateChannel, "the redis channel to publish notifications on")
+}
+
+// pool returns a pool connecting to the redis given by the flags.
+func (f *redisFlags) pool() (*redis.Pool, error) {
+	if f.addr == "" {
+		return nil, errors.New("no redis address given")
+	}
+
+	return &redis.Pool{
+		MaxIdle: 1,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", f.addr)
+		},
+	}, nil
+}
+
+// historyFlags are the flags shared by the subcommands that change keys.
+type historyFlags struct {
+	author string
+	maxLen int
+}
+
+// register adds the flags to the flag set.
+func (f *historyFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.author, "author", defaultAuthor(), "who is making the change, recorded in the history of the key")
+	fs.IntVar(&f.maxLen, "history-max-len", 0, "the number of changes to keep in the history of the key. zero keeps all")
+}
+
+// options returns the history options given by the flags.
+func (f *historyFlags) options() pkg.HistoryOptions {
+	return pkg.HistoryOptions{Author: f.author, MaxLen: f.maxLen}
+}
+
+// secretFlags are the flags of the subcommands that encrypt secrets.
+type secretFlags struct {
+	keyFile string
+}
+
+// register adds the flags to the flag set.
+func (f *secretFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.keyFile, "secret-key-file", "", fmt.Sprintf("a file holding the base64 encoded key to encrypt "+
+		"secrets with. defaults to the key in $%s", pkg.SecretKeyEnv))
+}
+
+// key loads the secret key given by the flags, which is required.
+func (f *secretFlags) key() (*pkg.SecretKey, error) {
+	key, err := pkg.LoadSecretKey(f.keyFile)
+	if err == nil && key == nil {
+		return nil, errors.Errorf("no secret key given, give one with -secret-key-file or $%s", pkg.SecretKeyEnv)
+	}
+
+	return key, err
+}
+
+// defaultAuthor returns the user running the command, and the host they are running it on.
+func defaultAuthor() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		return name + "@" + hostname
+	}
+
+	return name
+}
+
+// newFlagSet creates the flag set of a subcommand, printing the usage of its arguments along with its flags.
+func newFlagSet(name string, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: redis-template %s [flags] %s\n", name, arguments)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// fail prints the error and returns the exit code of a failed subcommand.
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	return 1
+}
+
+// errUsage is returned when a subcommand is given invalid arguments, so that its usage is printed.
+var errUsage = errors.New("invalid arguments")
+
+// applyChanges parses the flags, makes the changes given by the remaining arguments in one transaction, and
+// publishes a notification listing the changed keys. The arguments are parsed into changes by parse, which returns
+// errUsage if they are invalid.
+func applyChanges(fs *flag.FlagSet, args []string, conn *redisFlags, history *historyFlags,
+	parse func(args []string) ([]pkg.Change, error)) int {
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	changes, err := parse(fs.Args())
+	if err == errUsage {
+		fs.Usage()
+		return 2
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	if err := pkg.ApplyChanges(pool, conn.channel, changes, history.options()); err != nil {
+		return fail(err)
+	}
+
+	return 0
+}
+
+// runSet sets keys, recording the changes in their history, and publishes a notification. With -secret the values are
+// encrypted, so that only their ciphertext is stored in redis and in the history.
+func runSet(args []string) int {
+	var conn redisFlags
+	var history historyFlags
+	var secrets secretFlags
+	var secret bool
+
+	fs := newFlagSet("set", "<key> <value> [<key> <value>...]")
+	conn.register(fs)
+	history.register(fs)
+	secrets.register(fs)
+	fs.BoolVar(&secret, "secret", false, "encrypt the values with the secret key, so that templates read them with secret")
+
+	return applyChanges(fs, args, &conn, &history, func(args []string) ([]pkg.Change, error) {
+		if len(args) == 0 || len(args)%2 != 0 {
+			return nil, errUsage
+		}
+
+		var key *pkg.SecretKey
+		if secret {
+			var err error
+			if key, err = secrets.key(); err != nil {
+				return nil, err
+			}
+		}
+
+		var changes []pkg.Change
+		for i := 0; i < len(args); i += 2 {
+			value := args[i+1]
+			if key != nil {
+				var err error
+				if value, err = key.Encrypt(args[i], value); err != nil {
+					return nil, err
+				}
+			}
+
+			changes = append(changes, pkg.Change{Key: args[i], Value: pkg.StringValue(value)})
+		}
+
+		return changes, nil
+	})
+}
+
+// runDel deletes keys, recording the changes in their history, and publishes a notification.
+func runDel(args []string) int {
+	var conn redisFlags
+	var history historyFlags
+
+	fs := newFlagSet("del", "<key>...")
+	conn.register(fs)
+	history.register(fs)
+
+	return applyChanges(fs, args, &conn, &history, func(args []string) ([]pkg.Change, error) {
+		if len(args) == 0 {
+			return nil, errUsage
+		}
+
+		var changes []pkg.Change
+		for _, key := range args {
+			changes = append(changes, pkg.Change{Key: key})
+		}
+
+		return changes, nil
+	})
+}
+
+// runHSet sets fields of a hash, and publishes a notification.
+func runHSet(args []string) int {
+	var conn redisFlags
+	var history historyFlags
+
+	// changes to hashes aren't recorded in the history.
+	fs := newFlagSet("hset", "<key> <field> <value> [<field> <value>...]")
+	conn.register(fs)
+
+	return applyChanges(fs, args, &conn, &history, func(args []string) ([]pkg.Change, error) {
+		if len(args) < 3 || len(args)%2 != 1 {
+			return nil, errUsage
+		}
+
+		fields := map[string]string{}
+		for i := 1; i < len(args); i += 2 {
+			fields[args[i]] = args[i+1]
+		}
+
+		return []pkg.Change{{Key: args[0], Fields: fields}}, nil
+	})
+}
+
+// runPublish publishes a notification, listing the given keys as changed, so that listeners render their templates.
+// With a selector only the listeners it matches render.
+func runPublish(args []string) int {
+	var conn redisFlags
+	var selector string
+
+	fs := newFlagSet("publish", "[<key>...]")
+	conn.register(fs)
+	fs.StringVar(&selector, "selector", "", "only the nodes whose tags match the selector render, e.g. "+
+		"role=web,region=eu. node=web-1|web-2 matches nodes by name. every node renders when empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	parsed, err := pkg.ParseSelector(selector)
+	if err != nil {
+		return fail(err)
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	if err := pkg.PublishTo(pool, conn.channel, parsed, fs.Args()); err != nil {
+		return fail(err)
+	}
+
+	return 0
+}
+
+// runImport sets the keys given in a json, yaml or dotenv file, and publishes a notification listing the changed keys.
+func runImport(args []string) int {
+	var conn redisFlags
+	var history historyFlags
+	var prefix, format string
+	var dryRun, prune bool
+
+	fs := newFlagSet("import", "<file>")
+	conn.register(fs)
+	history.register(fs)
+	fs.StringVar(&prefix, "prefix", "", "a prefix added to every key, e.g. app")
+	fs.StringVar(&format, "format", "", fmt.Sprintf("the format of the file (%s|%s|%s). defaults to the file's extension",
+		pkg.FormatJSON, pkg.FormatYAML, pkg.FormatEnv))
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes without making them")
+	fs.BoolVar(&prune, "prune", false, "delete the keys under the prefix that aren't in the file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	values, err := readValuesFile(fs.Arg(0), format, prefix)
+	if err != nil {
+		return fail(err)
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	changes, err := pkg.PlanImport(pool, prefix, values, prune)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+
+	if dryRun || len(changes) == 0 {
+		fmt.Printf("%d changes\n", len(changes))
+		return 0
+	}
+
+	if err := pkg.ApplyChanges(pool, conn.channel, changes, history.options()); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("%d changes applied\n", len(changes))
+	return 0
+}
+
+// readValuesFile reads a json, yaml or dotenv file of values to import, flattening them into keys under the prefix.
+// The format defaults to the file's extension.
+func readValuesFile(path string, format string, prefix string) (map[string]pkg.Value, error) {
+	if format == "" {
+		format = pkg.FormatFromPath(path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	parsed, err := pkg.ParseValues(data, format)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+
+	return pkg.FlattenValues(prefix, parsed)
+}
+
+// keyValues is a flag that can be given more than once, each time setting a key to a value, e.g. -set db:host=10.0.0.2.
+type keyValues map[string]string
+
+// String implements flag.Value.
+func (v keyValues) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value.
+func (v keyValues) Set(pair string) error {
+	i := strings.Index(pair, "=")
+	if i <= 0 {
+		return errors.Errorf("invalid value %q, expected key=value", pair)
+	}
+
+	v[pair[:i]] = pair[i+1:]
+	return nil
+}
+
+// stringValues is a flag that can be given more than once, collecting every value in order, e.g. -key-prefix env:prod:.
+type stringValues []string
+
+// String implements flag.Value.
+func (v *stringValues) String() string {
+	return strings.Join(*v, ",")
+}
+
+// Set implements flag.Value.
+func (v *stringValues) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// runDiff renders the configured templates against the keys in redis, optionally overlaid with values that aren't
+// written to redis, and prints how the files they write would change. It exits with 0 if nothing would change, 1 if
+// something would, and 2 if the templates couldn't be rendered.
+func runDiff(args []string) int {
+	var conn redisFlags
+	var valuesFile, prefix, format string
+	set := keyValues{}
+
+	fs := newFlagSet("diff", "")
+	conn.register(fs)
+	registerTemplateFlags(fs)
+	fs.StringVar(&valuesFile, "values", "", "a json, yaml or dotenv file of values to render instead of the keys in redis")
+	fs.StringVar(&prefix, "prefix", "", "a prefix added to every key in the values file, e.g. app")
+	fs.StringVar(&format, "format", "", fmt.Sprintf("the format of the values file (%s|%s|%s). defaults to the file's extension",
+		pkg.FormatJSON, pkg.FormatYAML, pkg.FormatEnv))
+	fs.Var(set, "set", "a key=value to render instead of the key in redis. may be given more than once")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	// errors exit with 2, as 1 means that something would change.
+	failed := func(err error) int {
+		fail(err)
+		return 2
+	}
+
+	overlay := map[string]pkg.Value{}
+	if valuesFile != "" {
+		values, err := readValuesFile(valuesFile, format, prefix)
+		if err != nil {
+			return failed(err)
+		}
+
+		overlay = values
+	}
+
+	for key, value := range set {
+		overlay[key] = *pkg.StringValue(value)
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return failed(err)
+	}
+	defer pool.Close()
+
+	templates, err := loadTemplates(pool)
+	if err != nil {
+		return failed(err)
+	}
+
+	changed, outputs := 0, 0
+	for _, template := range templates {
+		if _, ok := template.Sink.(*pkg.FileSink); !ok && template.Sink != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s isn't a file and can't be compared\n", template.SourceTemplate.Name(), *template.Target)
+		}
+
+		diffs, err := template.Diff(overlay)
+		if err != nil {
+			return failed(errors.Wrapf(err, "failed to render template %s", template.SourceTemplate.Name()))
+		}
+
+		for _, diff := range diffs {
+			outputs++
+			if !diff.Changed() {
+				continue
+			}
+
+			changed++
+			unified, err := diff.Unified()
+			if err != nil {
+				return failed(err)
+			}
+
+			fmt.Print(unified)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d of %d files would change\n", changed, outputs)
+	if changed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runExport prints the keys under a prefix, or the keys read by the configured templates, in a format that can be
+// imported again.
+func runExport(args []string) int {
+	var conn redisFlags
+	var prefix, format string
+	var fromTemplates bool
+
+	fs := newFlagSet("export", "")
+	conn.register(fs)
+	registerTemplateFlags(fs)
+	fs.StringVar(&prefix, "prefix", "", "the prefix of the keys to export, which is removed from the exported keys")
+	fs.StringVar(&format, "format", pkg.FormatJSON, fmt.Sprintf("the format to export in (%s|%s|%s)",
+		pkg.FormatJSON, pkg.FormatYAML, pkg.FormatEnv))
+	fs.BoolVar(&fromTemplates, "from-templates", false,
+		"export the keys read by the templates given with -template and -config, instead of a prefix")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 0 || (fromTemplates && prefix != "") {
+		fs.Usage()
+		return 2
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	var values map[string]pkg.Value
+	if fromTemplates {
+		templates, err := loadTemplates(pool)
+		if err != nil {
+			return fail(err)
+		}
+
+		values, err = pkg.ExportTemplateKeys(pool, templates)
+		if err != nil {
+			return fail(err)
+		}
+	} else {
+		values, err = pkg.Export(pool, prefix)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	encoded, err := pkg.EncodeValues(values, prefix, format)
+	if err != nil {
+		return fail(err)
+	}
+
+	os.Stdout.Write(encoded)
+	return 0
+}
+
+// runLint checks the configured templates without rendering them, printing the problems found, and fails if any of
+// them are errors. If a redis address is given, the keys the templates read are checked to exist.
+func runLint(args []string) int {
+	var conn redisFlags
+	var format string
+
+	fs := newFlagSet("lint", "")
+	conn.register(fs)
+	registerTemplateFlags(fs)
+	fs.StringVar(&format, "format", "text", "the format to print the results in (text|json)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 0 || (format != "text" && format != "json") {
+		fs.Usage()
+		return 2
+	}
+
+	flags, prefixes, err := loadTemplateFlags()
+	if err != nil {
+		return fail(err)
+	}
+
+	var pool *redis.Pool
+	if conn.addr != "" {
+		pool, _ = conn.pool()
+		defer pool.Close()
+	}
+
+	reports := make([]pkg.LintReport, len(flags))
+	errorCount := 0
+	for i, templateFlag := range flags {
+		reports[i] = pkg.LintTemplate(templateFlag, pool, prefixes)
+		errorCount += reports[i].Errors()
+	}
+
+	if format == "json" {
+		encoded, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return fail(err)
+		}
+
+		fmt.Println(string(encoded))
+	} else {
+		printLintReports(reports)
+	}
+
+	if errorCount > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// printLintReports prints the lint reports as text.
+func printLintReports(reports []pkg.LintReport) {
+	issues := 0
+	for _, report := range reports {
+		issues += len(report.Issues)
+
+		fmt.Printf("%s", report.Source)
+		if report.Target != "" {
+			fmt.Printf(" -> %s", report.Target)
+		}
+
+		fmt.Println()
+		if len(report.Keys) > 0 {
+			fmt.Printf("  keys: %s\n", strings.Join(report.Keys, ", "))
+		}
+
+		if len(report.Prefixes) > 0 {
+			fmt.Printf("  prefixes: %s\n", strings.Join(report.Prefixes, ", "))
+		}
+
+		if len(report.Missing) > 0 {
+			fmt.Printf("  missing: %s\n", strings.Join(report.Missing, ", "))
+		}
+
+		for _, issue := range report.Issues {
+			fmt.Printf("  %s\n", issue)
+		}
+	}
+
+	errorCount := 0
+	for _, report := range reports {
+		errorCount += report.Errors()
+	}
+
+	fmt.Printf("%d templates, %d errors, %d warnings\n", len(reports), errorCount, issues-errorCount)
+}
+
+// runStatus prints the state of every node reporting the state of its templates, and the leader of their election if
+// there is one, and fails if any of them are stale or failing.
+func runStatus(args []string) int {
+	var conn redisFlags
+	var format string
+	var election string
+
+	fs := newFlagSet("status", "")
+	conn.register(fs)
+	fs.StringVar(&format, "format", "text", "the format to print the state of the nodes in (text|json)")
+	fs.StringVar(&election, "leader-election", "default", "the election to print the leader of")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 0 || (format != "text" && format != "json") {
+		fs.Usage()
+		return 2
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	report, err := pkg.FleetStatus(pool)
+	if err != nil {
+		return fail(err)
+	}
+
+	leader, err := pkg.GetLeader(pool, election)
+	if err != nil {
+		return fail(err)
+	}
+
+	if leader.ID != "" {
+		report.Leader = &leader
+	}
+
+	if format == "json" {
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fail(err)
+		}
+
+		fmt.Println(string(encoded))
+	} else {
+		printFleetReport(report)
+	}
+
+	for _, node := range report.Nodes {
+		if node.State != pkg.NodeUpToDate {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// printFleetReport prints the state of the nodes as a table, followed by the errors of the failing templates.
+func printFleetReport(report pkg.FleetReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tSTATE\tGENERATION\tUPDATED\tTEMPLATES")
+
+	counts := map[string]int{}
+	for _, node := range report.Nodes {
+		counts[node.State]++
+
+		updated := "never"
+		if !node.Updated.IsZero() {
+			updated = node.Updated.Local().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%d\n", node.Node, node.State, node.Generation, report.Generation, updated,
+			len(node.Templates))
+	}
+
+	w.Flush()
+
+	for _, node := range report.Nodes {
+		for _, template := range node.Templates {
+			if template.Error != "" {
+				fmt.Printf("%s %s: %s\n", node.Node, template.Name, template.Error)
+			}
+		}
+	}
+
+	fmt.Printf("%d nodes, %d up to date, %d stale, %d failing\n", len(report.Nodes), counts[pkg.NodeUpToDate],
+		counts[pkg.NodeStale], counts[pkg.NodeFailing])
+
+	if report.Leader != nil {
+		fmt.Printf("%s leads election %s with fencing token %d\n", report.Leader.ID, report.Leader.Name,
+			report.Leader.FencingToken)
+	}
+}
+
+// runRollout prints the state of a rolling reload. With -reset the rollout's failures are cleared, resuming it if it
+// was halted, and a notification is published so that the nodes that skipped their reload reload.
+func runRollout(args []string) int {
+	var conn redisFlags
+	var reset bool
+
+	fs := newFlagSet("rollout", "<name>")
+	conn.register(fs)
+	fs.BoolVar(&reset, "reset", false, "clear the failures of the rollout, resuming it if it was halted")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	name := fs.Arg(0)
+	if reset {
+		if err := pkg.ResetRollout(pool, name); err != nil {
+			return fail(err)
+		}
+
+		if err := pkg.Publish(pool, conn.channel, nil); err != nil {
+			return fail(err)
+		}
+	}
+
+	status, err := pkg.GetRollout(pool, name)
+	if err != nil {
+		return fail(err)
+	}
+
+	state := "running"
+	if status.Halted {
+		state = "halted"
+	}
+
+	fmt.Printf("%s: %s, %d failures\n", status.Name, state, status.Failures)
+	for _, holder := range status.Holders {
+		fmt.Printf("  reloading: %s\n", holder)
+	}
+
+	return 0
+}
+
+// runHistory prints the changes made to a key, newest first.
+func runHistory(args []string) int {
+	var conn redisFlags
+	var count int
+
+	fs := newFlagSet("history", "<key>")
+	conn.register(fs)
+	fs.IntVar(&count, "n", 20, "the number of changes to print. zero prints all")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	entries, err := pkg.History(pool, fs.Arg(0), count)
+	if err != nil {
+		return fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTIME\tAUTHOR\tOLD\tNEW")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.Version, entry.Time.Format(time.RFC3339), entry.Author,
+			formatValue(entry.Old), formatValue(entry.New))
+	}
+
+	w.Flush()
+	return 0
+}
+
+// runRollback restores a previous value of a key, and publishes a notification.
+func runRollback(args []string) int {
+	var conn redisFlags
+	var history historyFlags
+
+	fs := newFlagSet("rollback", "<key> [version]")
+	conn.register(fs)
+	history.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	pool, err := conn.pool()
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.Close()
+
+	value, err := pkg.Rollback(pool, conn.channel, fs.Arg(0), fs.Arg(1), history.options())
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("restored %s to %s\n", fs.Arg(0), formatValue(value))
+	return 0
+}
+
+// formatValue formats a value for printing, showing keys that don't exist as (none).
+func formatValue(value *string) string {
+	if value == nil {
+		return "(none)"
+	}
+
+	return strconv.Quote(*value)
+}
+
+// runEncrypt encrypts a value with the secret key, printing the encrypted value to store in redis as the given key,
+// which it can only be decrypted as. The value is read from stdin if it isn't given, so that it doesn't appear in the
+// shell's history. With -generate-key a new key is printed instead.
+func runEncrypt(args []string) int {
+	var secrets secretFlags
+	var generate bool
+
+	fs := newFlagSet("encrypt", "<key> [<value>]")
+	secrets.register(fs)
+	fs.BoolVar(&generate, "generate-key", false, "print a new random key, to give to -secret-key-file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if generate {
+		key, err := pkg.GenerateSecretKey()
+		if err != nil {
+			return fail(err)
+		}
+
+		fmt.Println(key)
+		return 0
+	}
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	key, err := secrets.key()
+	if err != nil {
+		return fail(err)
+	}
+
+	value := fs.Arg(1)
+	if fs.NArg() == 1 {
+		contents, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fail(err)
+		}
+
+		value = strings.TrimSuffix(string(contents), "\n")
+	}
+
+	envelope, err := key.Encrypt(fs.Arg(0), value)
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Println(envelope)
+	return 0
+}
@@ -3,9 +3,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
 	"github.com/robbert229/redis-template/pkg"
 	"github.com/sirupsen/logrus"
 )
@@ -15,21 +22,93 @@ var redisAddr string
 var splay time.Duration
 var redisChannel string
 var logLevel string
+var logFormat string
+var logFile string
+var configFile string
+var strict bool
+var missingKeyWait time.Duration
+var missingKeyFallback bool
+var consistent bool
+var keyPrefixes stringValues
+var secretKeyFile string
+var redisMaxIdle int
+var redisMaxActive int
+var redisIdleTimeout time.Duration
+var cache bool
+var metricsAddr string
+var reconnectAttempts int
+var healthAddr string
+var healthThreshold time.Duration
+var readyFile string
+var apiAddr string
+var watchTemplates bool
+var templateLib string
+var nodeName string
+var nodeTags = keyValues{}
+var fleetTTL time.Duration
+var leaderElection string
+var leaderTTL time.Duration
 
 const (
+	LogLevelTrace = "TRACE"
 	LogLevelDebug = "DEBUG"
 	LogLevelInfo  = "INFO"
 	LogLevelWarn  = "WARN"
 	LogLevelError = "ERROR"
 )
 
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
 func main() {
-	flag.Var(&templateFlags, "template", "a template to process")
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	registerTemplateFlags(flag.CommandLine)
 	flag.StringVar(&redisAddr, "redis-addr", "", "the redis connection string")
+	flag.IntVar(&redisMaxIdle, "redis-max-idle", 3, "the maximum number of idle connections kept in the redis pool")
+	flag.IntVar(&redisMaxActive, "redis-max-active", 0,
+		"the maximum number of connections open to redis at once. zero is unlimited")
+	flag.DurationVar(&redisIdleTimeout, "redis-idle-timeout", 4*time.Minute,
+		"close redis connections that have been idle for longer than this duration")
+	flag.BoolVar(&cache, "cache", false,
+		"cache the values read from redis between renders, using client side caching. requires redis 6 or later")
+	flag.IntVar(&reconnectAttempts, "reconnect-attempts", 0,
+		"the number of times in a row to reestablish a failed subscription before exiting")
+	flag.StringVar(&metricsAddr, "metrics-addr", "",
+		"the address to serve prometheus metrics on at /metrics, e.g. :9100. disabled when empty")
+	flag.StringVar(&healthAddr, "health-addr", "",
+		"the address to serve the /healthz and /readyz probes on, e.g. :8080. disabled when empty")
+	flag.DurationVar(&healthThreshold, "health-threshold", 30*time.Second,
+		"how long the pubsub connection can go without being confirmed alive before /healthz fails")
+	flag.StringVar(&readyFile, "ready-file", "", "a file to write once every template has rendered successfully")
+	flag.StringVar(&apiAddr, "api-addr", "", "the address to serve the status api on. addresses without a host are "+
+		"bound to localhost, and unix:/path serves on a unix socket. disabled when empty")
+	flag.DurationVar(&fleetTTL, "fleet-ttl", 0, "report the state of the templates to redis after every update, "+
+		"expiring the report if no heartbeat is sent within this duration. see the status subcommand. disabled when zero")
+	flag.StringVar(&leaderElection, "leader-election", "default", "the election to elect the leader in, which runs "+
+		"the commands of templates with run_on leader. nodes in the same election share a leader")
+	flag.DurationVar(&leaderTTL, "leader-ttl", 0,
+		"how long the leadership lasts if the leader stops renewing it, e.g. because it died, such as 15s. the node "+
+			"only campaigns when it is set, which templates with run_on leader require")
+	flag.BoolVar(&watchTemplates, "watch-templates", false,
+		"watch the template sources, parsing and rendering templates again when they change. for local development")
 	flag.StringVar(&redisChannel, "redis-chan", pkg.RedisTemplateChannel, "the redis channel to listen for updates on")
 	flag.DurationVar(&splay, "splay", time.Duration(0), "This is a random splay to wait before killing the command")
-	flag.StringVar(&logLevel, "log-level", LogLevelError, fmt.Sprintf("the logging level. (%s|%s|%s|%s)",
-		LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError))
+	flag.StringVar(&logLevel, "log-level", LogLevelError, fmt.Sprintf("the logging level. (%s|%s|%s|%s|%s)",
+		LogLevelTrace, LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError))
+	flag.StringVar(&logFormat, "log-format", LogFormatText, fmt.Sprintf("the logging format. (%s|%s)",
+		LogFormatText, LogFormatJSON))
+	flag.StringVar(&logFile, "log-file", "", "a file to append the logs to instead of stderr")
+	flag.DurationVar(&missingKeyWait, "missing-key-wait", time.Duration(0),
+		"how long to hold a template whose keys are missing on its first render before giving up on it")
+	flag.BoolVar(&missingKeyFallback, "missing-key-fallback", false,
+		"render missing keys empty, instead of failing, once missing-key-wait has passed")
 
 	flag.Parse()
 
@@ -39,8 +118,8 @@ func main() {
 		return
 	}
 
-	if len(templateFlags) == 0 {
-		fmt.Println("no templates given")
+	if leaderTTL != 0 && leaderTTL < pkg.MinLeaderTTL {
+		fmt.Printf("invalid leader-ttl given: %s, expected at least %s\n", leaderTTL, pkg.MinLeaderTTL)
 		flag.Usage()
 		return
 	}
@@ -48,7 +127,7 @@ func main() {
 	logger := logrus.New()
 
 	switch logLevel {
-	case LogLevelDebug:
+	case LogLevelTrace, LogLevelDebug:
 		logger.SetLevel(logrus.DebugLevel)
 	case LogLevelInfo:
 		logger.SetLevel(logrus.InfoLevel)
@@ -62,32 +141,375 @@ func main() {
 		return
 	}
 
+	// the values read from redis are redacted from the logs, as they may be secrets.
+	redactor := pkg.NewRedactor()
+
+	switch logFormat {
+	case LogFormatText:
+		logger.Formatter = redactor.Formatter(&logrus.TextFormatter{})
+	case LogFormatJSON:
+		logger.Formatter = redactor.Formatter(&logrus.JSONFormatter{})
+	default:
+		fmt.Println("invalid log-format given: ", logFormat)
+		flag.Usage()
+		return
+	}
+
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			fmt.Println("failed to open log file: ", err)
+			return
+		}
+
+		defer f.Close()
+		logger.Out = f
+	}
+
 	pool := &redis.Pool{
+		MaxIdle:     redisMaxIdle,
+		MaxActive:   redisMaxActive,
+		IdleTimeout: redisIdleTimeout,
+		Wait:        redisMaxActive > 0,
 		Dial: func() (redis.Conn, error) {
 			return redis.Dial("tcp", redisAddr)
 		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// connections that have been used recently are assumed to be healthy.
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+
+			_, err := c.Do("PING")
+			return err
+		},
 	}
 
-	// parse all of the templates and anchor the redis pool into scope.
-	templates := make([]pkg.Template, len(templateFlags))
-	for i := 0; i < len(templateFlags); i++ {
-		tmpl, err := templateFlags[i].ToTemplate(pool)
-		if err != nil {
-			logger.WithError(err).Fatalf("failed build template")
-		}
+	templates, err := loadTemplates(pool)
+	if err == nil {
+		err = checkLeaderTemplates(templates)
+	}
 
-		templates[i] = tmpl
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		return
 	}
 
 	cfg := pkg.Config{
 		Pool:      pool,
 		Logger:    logger,
-		Channel:   pkg.RedisTemplateChannel,
+		Channel:   redisChannel,
 		Splay:     splay,
 		Templates: templates,
+
+		MissingKeyWait:     missingKeyWait,
+		MissingKeyFallback: missingKeyFallback,
+		ReconnectAttempts:  reconnectAttempts,
+		Redactor:           redactor,
+		Trace:              logLevel == LogLevelTrace,
+		WatchTemplates:     watchTemplates,
+		Node:               nodeName,
+		Tags:               nodeTags,
+	}
+
+	if cache {
+		cfg.Cache = pkg.NewCache()
+	}
+
+	if metricsAddr != "" {
+		cfg.Metrics = pkg.NewMetrics()
+		handle(metricsAddr, "/metrics", cfg.Metrics)
+	}
+
+	if healthAddr != "" || readyFile != "" || apiAddr != "" {
+		cfg.Status = pkg.NewStatus(healthThreshold, readyFile)
+	}
+
+	if fleetTTL > 0 {
+		cfg.Fleet = pkg.NewFleet(nodeName, fleetTTL)
 	}
 
+	if leaderTTL > 0 {
+		cfg.Election = pkg.NewElection(pool, leaderElection, fmt.Sprintf("%s:%d", nodeName, os.Getpid()), leaderTTL)
+	}
+
+	if apiAddr != "" {
+		if strings.HasPrefix(apiAddr, ":") {
+			apiAddr = "127.0.0.1" + apiAddr
+		}
+
+		cfg.Reload = make(chan struct{})
+		handle(apiAddr, "/", pkg.APIHandler(cfg.Status, cfg.Reload))
+	}
+
+	if healthAddr != "" {
+		handle(healthAddr, "/healthz", cfg.Status.HealthHandler())
+		handle(healthAddr, "/readyz", cfg.Status.ReadyHandler())
+	}
+
+	serve(logger)
+
+	cfg.Reconfigure = make(chan []pkg.Template)
+	cfg.ForceReload = make(chan struct{})
+	go handleSignals(cfg, pool)
+
 	if err := pkg.Listen(cfg); err != nil {
 		cfg.Logger.WithError(err).Fatal("failed to listen to redis")
 	}
 }
+
+// defaultNodeName returns the hostname, which is the default name of the node.
+func defaultNodeName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return hostname
+}
+
+// templateFlagSet is the flag set the template flags were registered on, by registerTemplateFlags.
+var templateFlagSet = flag.CommandLine
+
+// registerTemplateFlags registers the flags configuring the templates on the flag set. They are shared by the
+// subcommands that work with the configured templates.
+func registerTemplateFlags(fs *flag.FlagSet) {
+	templateFlagSet = fs
+	fs.Var(&templateFlags, "template", "a template to process")
+	fs.StringVar(&configFile, "config", "", "a json file containing additional templates and settings")
+	fs.StringVar(&templateLib, "template-lib", "",
+		"a glob matching template files to parse into every template, so that the templates they define can be used")
+	fs.BoolVar(&strict, "strict", true, "fail to render templates that read missing keys instead of rendering them empty")
+	fs.BoolVar(&consistent, "consistent", false,
+		"render templates from a consistent snapshot of their keys, retrying renders when keys change mid-render")
+	fs.Var(&keyPrefixes, "key-prefix", "a prefix to look keys up under, e.g. env:prod: or node:{{.Hostname}}:. keys "+
+		"resolve to the first prefix they exist under. may be given more than once, in order of precedence")
+	fs.StringVar(&secretKeyFile, "secret-key-file", "", fmt.Sprintf("a file holding the base64 encoded key that "+
+		"decrypts the keys read with secret. defaults to the key in $%s", pkg.SecretKeyEnv))
+	fs.StringVar(&nodeName, "node", defaultNodeName(), "the name of this node, which notifications can be addressed to "+
+		"and the state of its templates is reported under")
+	fs.Var(nodeTags, "tag", "a label=value tag of this node, e.g. role=web, which notifications can be addressed to. "+
+		"may be given more than once")
+}
+
+// loadTemplates reads the config file, if there is one, and parses every template given on the command line and in the
+// config file. It is called on start up, and again whenever redis-template is sent SIGHUP.
+func loadTemplates(pool *redis.Pool) ([]pkg.Template, error) {
+	flags, prefixes, err := loadTemplateFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	secretKey, err := pkg.LoadSecretKey(secretKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the secret key")
+	}
+
+	// parse all of the templates and anchor the redis pool into scope.
+	templates := make([]pkg.Template, len(flags))
+	for i := 0; i < len(flags); i++ {
+		tmpl, err := flags[i].ToTemplate(pool)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to build template %s", flags[i].Source)
+		}
+
+		tmpl.KeyPrefixes = prefixes
+		tmpl.SecretKey = secretKey
+		templates[i] = tmpl
+	}
+
+	return templates, nil
+}
+
+// loadTemplateFlags returns every template given on the command line and in the config file, if there is one, with
+// glob sources expanded and the defaults given by the flags and config file applied, and the rendered key prefixes.
+func loadTemplateFlags() (pkg.TemplateFlags, []string, error) {
+	flags := append(pkg.TemplateFlags{}, templateFlags...)
+	defaultStrict := strict
+	defaultLib := templateLib
+	prefixes := []string(keyPrefixes)
+
+	if configFile != "" {
+		fileConfig, err := pkg.LoadFileConfig(configFile)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to load config file")
+		}
+
+		if len(fileConfig.KeyPrefixes) > 0 && !isFlagSet("key-prefix") {
+			prefixes = fileConfig.KeyPrefixes
+		}
+
+		if fileConfig.Strict != nil && !isFlagSet("strict") {
+			defaultStrict = *fileConfig.Strict
+		}
+
+		if fileConfig.TemplateLib != "" && !isFlagSet("template-lib") {
+			defaultLib = fileConfig.TemplateLib
+		}
+
+		flags = append(flags, fileConfig.Templates...)
+	}
+
+	if len(flags) == 0 {
+		return nil, nil, errors.New("no templates given")
+	}
+
+	// expand the templates with glob sources into a template per file.
+	var expanded pkg.TemplateFlags
+	for _, templateFlag := range flags {
+		matches, err := templateFlag.Expand()
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		expanded = append(expanded, matches...)
+	}
+
+	flags = expanded
+
+	for i := 0; i < len(flags); i++ {
+		if flags[i].Strict == nil {
+			flags[i].Strict = &defaultStrict
+		}
+
+		if consistent {
+			flags[i].Consistent = true
+		}
+
+		if flags[i].Library == "" {
+			flags[i].Library = defaultLib
+		}
+	}
+
+	node := nodeName
+	if node == "" {
+		node = defaultNodeName()
+	}
+
+	data := pkg.KeyPrefixData{Hostname: defaultNodeName(), Node: node, Tags: nodeTags}
+	prefixes, err := pkg.RenderKeyPrefixes(prefixes, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return flags, prefixes, nil
+}
+
+// handleSignals reloads the configuration and templates when sent SIGHUP, and forces every template to be rendered and
+// its command run when sent SIGUSR1. If the configuration fails to reload the running configuration is kept.
+func handleSignals(cfg pkg.Config, pool *redis.Pool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			cfg.Logger.Info("reloading configuration")
+			templates, err := loadTemplates(pool)
+			if err == nil {
+				err = checkLeaderTemplates(templates)
+			}
+
+			if err != nil {
+				cfg.Logger.WithError(err).Error("failed to reload configuration, keeping the running configuration")
+				continue
+			}
+
+			warnUnsupportedSettings(cfg.Logger)
+			cfg.Reconfigure <- templates
+		case syscall.SIGUSR1:
+			cfg.Logger.Info("forcing templates to render")
+			cfg.ForceReload <- struct{}{}
+		}
+	}
+}
+
+// warnUnsupportedSettings warns about the settings in the config file that are ignored. Settings other than the
+// templates, their defaults and the key prefixes can only be given on the command line, so changing them needs a
+// restart.
+func warnUnsupportedSettings(logger *logrus.Logger) {
+	if configFile == "" {
+		return
+	}
+
+	fileConfig, err := pkg.LoadFileConfig(configFile)
+	if err != nil {
+		return
+	}
+
+	for _, setting := range fileConfig.Unsupported {
+		name := strings.Replace(setting, "_", "-", -1)
+		if flag.Lookup(name) != nil {
+			logger.WithField("setting", setting).Warnf("-%s can't be set in the config file, "+
+				"changing it needs a restart", name)
+		} else {
+			logger.WithField("setting", setting).Warn("ignoring unknown config file setting")
+		}
+	}
+}
+
+// checkLeaderTemplates returns an error if a template runs its command on the leader but no leader is elected, as its
+// command would never run.
+func checkLeaderTemplates(templates []pkg.Template) error {
+	if leaderTTL > 0 {
+		return nil
+	}
+
+	for _, template := range templates {
+		if template.RunsOnLeader() {
+			return errors.Errorf("template %s runs on the leader, which needs -leader-ttl", template.SourceTemplate.Name())
+		}
+	}
+
+	return nil
+}
+
+// isFlagSet reports whether the flag with the given name was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	templateFlagSet.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// servers are the http servers to start, by the address they listen on. Endpoints given the same address share a
+// server.
+var servers = map[string]*http.ServeMux{}
+
+// handle registers the handler for the pattern on the server listening on the given address.
+func handle(addr string, pattern string, handler http.Handler) {
+	mux, ok := servers[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		servers[addr] = mux
+	}
+
+	mux.Handle(pattern, handler)
+}
+
+// serve starts all of the http servers. Addresses of the form unix:/path are served on a unix socket.
+func serve(logger *logrus.Logger) {
+	for addr, mux := range servers {
+		network, address := "tcp", addr
+		if strings.HasPrefix(addr, "unix:") {
+			network, address = "unix", strings.TrimPrefix(addr, "unix:")
+			os.Remove(address)
+		}
+
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			logger.WithError(err).WithField("addr", addr).Fatal("failed to listen")
+		}
+
+		go func(addr string, mux *http.ServeMux) {
+			if err := http.Serve(listener, mux); err != nil {
+				logger.WithError(err).WithField("addr", addr).Fatal("failed to serve http")
+			}
+		}(addr, mux)
+	}
+}
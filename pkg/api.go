@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// APIHandler returns an http.Handler serving the status api, which allows a running redis-template to be inspected.
+//
+//	GET  /templates               lists the status of every template.
+//	GET  /templates/{name}/render renders the template, named by its source path, against the current values in redis.
+//	                              The secrets it reads are redacted.
+//	POST /reload                  updates the templates, as if a message had been published.
+//
+// Reloads are sent to the reload channel, which should be given to Listen in Config.Reload.
+func APIHandler(status *Status, reload chan<- struct{}) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status.Templates())
+	})
+
+	mux.HandleFunc("/templates/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/render") {
+			http.NotFound(w, r)
+			return
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/templates/"), "/render")
+		template, ok := status.template(name)
+		if !ok {
+			http.Error(w, "template not found", http.StatusNotFound)
+			return
+		}
+
+		buffer := bytes.NewBuffer(nil)
+		result, err := template.renderWith(buffer, renderOptions{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(redactSecrets(buffer.String(), result.secrets)))
+	})
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		select {
+		case reload <- struct{}{}:
+			w.WriteHeader(http.StatusAccepted)
+		case <-r.Context().Done():
+		}
+	})
+
+	return mux
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIHandler(t *testing.T) {
+	status := NewStatus(time.Minute, "")
+	err := status.setTemplates([]Template{
+		{SourceTemplate: template.New("/app/foo.json.tmpl"), state: &templateState{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload := make(chan struct{}, 1)
+	handler := APIHandler(status, reload)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/templates", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var statuses []TemplateStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "/app/foo.json.tmpl", statuses[0].Name)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/templates/app/missing.tmpl/render", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/reload", nil))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Len(t, reload, 1)
+}
@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// invalidationChannel is the channel redis publishes invalidation messages on when client side caching is redirected
+// to another connection.
+const invalidationChannel = "__redis__:invalidate"
+
+// cacheReconnectInterval is how long the cache waits before reconnecting its invalidation connection after it fails.
+const cacheReconnectInterval = time.Second
+
+// Cache is a local cache of the values read from redis. It relies upon redis's client side caching (CLIENT TRACKING),
+// redis remembers which keys have been read through a tracked connection, and sends an invalidation message to the
+// cache's connection when any of them are modified. While the invalidation connection is down the cache is empty and
+// unused.
+//
+// Redis forgets the keys read through a tracked connection once it is closed, so cached renders read through a single
+// long-lived connection rather than the pool, and the cache is emptied whenever that connection is replaced.
+type Cache struct {
+	mut    sync.Mutex
+	values map[string]*string
+
+	// clientID is the id of the connection receiving the invalidation messages. It is zero while disconnected.
+	clientID int64
+
+	// generation is incremented on every invalidation. A value is only stored if no invalidations have happened since
+	// it was read, otherwise the value may have been invalidated before it was stored.
+	generation uint64
+
+	// dial opens a new connection to redis. It is set once the cache runs.
+	dial func() (redis.Conn, error)
+
+	// connMut is held by the render reading through conn, the tracked connection, whose invalidations are redirected to
+	// the connection with connID.
+	connMut sync.Mutex
+	conn    redis.Conn
+	connID  int64
+}
+
+// NewCache creates an empty Cache.
+func NewCache() *Cache {
+	return &Cache{values: map[string]*string{}}
+}
+
+// tracking returns the id of the invalidation connection, and the current generation of the cache. The id is zero
+// when the cache isn't available.
+func (c *Cache) tracking() (int64, uint64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.clientID, c.generation
+}
+
+// acquire returns the tracked connection for a render to read through, and the current generation of the cache. The
+// connection is held by the render until it calls release. ok is false if the cache isn't available, in which case
+// the render reads directly from redis.
+func (c *Cache) acquire() (conn redis.Conn, generation uint64, release func(), ok bool) {
+	if c == nil {
+		return nil, 0, nil, false
+	}
+
+	c.connMut.Lock()
+
+	c.mut.Lock()
+	id, dial := c.clientID, c.dial
+	c.mut.Unlock()
+
+	if id == 0 || dial == nil {
+		c.connMut.Unlock()
+		return nil, 0, nil, false
+	}
+
+	if c.conn == nil || c.conn.Err() != nil || c.connID != id {
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+
+			// redis no longer tracks the keys read through the closed connection, so they would never be invalidated.
+			c.invalidate()
+		}
+
+		conn, err := dial()
+		if err == nil {
+			if _, err = conn.Do("CLIENT", "TRACKING", "on", "REDIRECT", id); err != nil {
+				conn.Close()
+			}
+		}
+
+		if err != nil {
+			c.connMut.Unlock()
+			return nil, 0, nil, false
+		}
+
+		c.conn, c.connID = conn, id
+	}
+
+	_, generation = c.tracking()
+	return c.conn, generation, c.connMut.Unlock, true
+}
+
+// get returns the cached value of the key. A nil value is a key that is cached as not existing.
+func (c *Cache) get(key string) (value *string, ok bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	value, ok = c.values[key]
+	return value, ok
+}
+
+// store caches the value of the key, if nothing has been invalidated since the given generation.
+func (c *Cache) store(key string, value *string, generation uint64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.clientID == 0 || c.generation != generation {
+		return
+	}
+
+	c.values[key] = value
+}
+
+// invalidate removes the given keys from the cache. If no keys are given the whole cache is emptied.
+func (c *Cache) invalidate(keys ...string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.generation++
+	if len(keys) == 0 {
+		c.values = map[string]*string{}
+		return
+	}
+
+	for _, key := range keys {
+		delete(c.values, key)
+	}
+}
+
+// setClientID sets the id of the invalidation connection, emptying the cache as any invalidations sent while it was
+// disconnected have been lost.
+func (c *Cache) setClientID(id int64) {
+	c.mut.Lock()
+	c.clientID = id
+	c.mut.Unlock()
+
+	c.invalidate()
+}
+
+// listen receives invalidation messages from redis until the connection fails.
+func (c *Cache) listen(p *redis.Pool, logger *log.Logger) error {
+	conn, err := p.Dial()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer conn.Close()
+	defer c.setClientID(0)
+
+	id, err := redis.Int64(conn.Do("CLIENT", "ID"))
+	if err != nil {
+		return errors.Wrap(err, "failed to get the client id of the invalidation connection")
+	}
+
+	if _, err := conn.Do("SUBSCRIBE", invalidationChannel); err != nil {
+		return errors.WithStack(err)
+	}
+
+	c.setClientID(id)
+	logger.WithField("client_id", id).Debug("render cache connected")
+
+	for {
+		reply, err := redis.Values(conn.Receive())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if len(reply) != 3 {
+			continue
+		}
+
+		if kind, _ := redis.String(reply[0], nil); kind != "message" {
+			continue
+		}
+
+		// a nil payload means that the whole database was flushed.
+		keys, err := redis.Strings(reply[2], nil)
+		if err != nil && err != redis.ErrNil {
+			return errors.Wrap(err, "invalid invalidation message")
+		}
+
+		logger.WithField("keys", keys).Debug("render cache invalidated")
+		c.invalidate(keys...)
+	}
+}
+
+// run keeps the cache's invalidation connection open, reconnecting whenever it fails.
+func (c *Cache) run(p *redis.Pool, logger *log.Logger) {
+	c.mut.Lock()
+	c.dial = p.Dial
+	c.mut.Unlock()
+
+	for {
+		if err := c.listen(p, logger); err != nil {
+			logger.WithError(err).Warn("render cache disconnected, renders will read directly from redis")
+		}
+
+		time.Sleep(cacheReconnectInterval)
+	}
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_Invalidate(t *testing.T) {
+	cache := NewCache()
+	cache.setClientID(1)
+
+	value := "localhost"
+	_, generation := cache.tracking()
+	cache.store("db:host", &value, generation)
+	cache.store("db:port", nil, generation)
+
+	cached, ok := cache.get("db:host")
+	if assert.True(t, ok) {
+		assert.Equal(t, "localhost", *cached)
+	}
+
+	cached, ok = cache.get("db:port")
+	assert.True(t, ok)
+	assert.Nil(t, cached)
+
+	cache.invalidate("db:host")
+
+	_, ok = cache.get("db:host")
+	assert.False(t, ok)
+
+	_, ok = cache.get("db:port")
+	assert.True(t, ok)
+
+	cache.invalidate()
+
+	_, ok = cache.get("db:port")
+	assert.False(t, ok)
+}
+
+func TestCache_StoreAfterInvalidation(t *testing.T) {
+	cache := NewCache()
+	cache.setClientID(1)
+
+	// a value read before an invalidation may be stale, so it must not be stored.
+	value := "localhost"
+	_, generation := cache.tracking()
+	cache.invalidate("db:host")
+	cache.store("db:host", &value, generation)
+
+	_, ok := cache.get("db:host")
+	assert.False(t, ok)
+}
+
+func TestCache_Disconnected(t *testing.T) {
+	cache := NewCache()
+
+	id, generation := cache.tracking()
+	assert.Equal(t, int64(0), id)
+
+	value := "localhost"
+	cache.store("db:host", &value, generation)
+
+	_, ok := cache.get("db:host")
+	assert.False(t, ok)
+
+	var nilCache *Cache
+	id, _ = nilCache.tracking()
+	assert.Equal(t, int64(0), id)
+}
+
+// trackedConn is a redis.Conn that records the commands sent through it.
+type trackedConn struct {
+	redis.Conn
+	commands []string
+	err      error
+}
+
+func (c *trackedConn) Do(command string, args ...interface{}) (interface{}, error) {
+	c.commands = append(c.commands, command)
+	return "OK", nil
+}
+
+func (c *trackedConn) Err() error {
+	return c.err
+}
+
+func (c *trackedConn) Close() error {
+	c.err = errors.New("closed")
+	return nil
+}
+
+func TestCache_Acquire(t *testing.T) {
+	var nilCache *Cache
+	_, _, _, ok := nilCache.acquire()
+	assert.False(t, ok)
+
+	var conns []*trackedConn
+	cache := NewCache()
+	cache.dial = func() (redis.Conn, error) {
+		conn := &trackedConn{}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+
+	_, _, _, ok = cache.acquire()
+	assert.False(t, ok, "the cache is unavailable while disconnected")
+
+	cache.setClientID(1)
+	conn, generation, release, ok := cache.acquire()
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, []string{"CLIENT"}, conns[0].commands)
+
+	value := "localhost"
+	cache.store("db:host", &value, generation)
+	release()
+
+	// the tracked connection is reused by later renders.
+	again, _, release, ok := cache.acquire()
+	assert.True(t, ok)
+	assert.Equal(t, conn, again)
+	release()
+
+	_, ok = cache.get("db:host")
+	assert.True(t, ok)
+
+	// once the tracked connection is lost redis no longer invalidates its keys, so the cache is emptied.
+	conns[0].err = errors.New("broken")
+	again, _, release, ok = cache.acquire()
+	assert.True(t, ok)
+	assert.NotEqual(t, conn, again)
+	release()
+
+	_, ok = cache.get("db:host")
+	assert.False(t, ok)
+	assert.Len(t, conns, 2)
+}
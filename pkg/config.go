@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -28,6 +30,72 @@ type Config struct {
 	Templates []Template
 	Splay     time.Duration
 	Channel   string
+
+	// Cache, if set, caches the values read from redis between renders. It requires redis 6 or later.
+	Cache *Cache
+
+	// Metrics, if set, records metrics about the renders, commands and subscription.
+	Metrics *Metrics
+
+	// Redactor, if set, is given the values read from redis so that they can be removed from the logs.
+	Redactor *Redactor
+
+	// Trace causes the payloads of the messages received to be logged at the debug level.
+	Trace bool
+
+	// Status, if set, tracks the health of the subscription and which templates have rendered. The subscription is
+	// pinged periodically so that a dead connection is noticed.
+	Status *Status
+
+	// Fleet, if set, reports the state of the templates to redis after every update, so that the state of every node
+	// can be seen with FleetStatus.
+	Fleet *Fleet
+
+	// Node is the name of the node, and Tags are its tags, e.g. role=web. Notifications with a selector are only
+	// rendered by the nodes it matches.
+	Node string
+	Tags map[string]string
+
+	// Election, if set, elects the node that runs the commands of the templates that run on the leader. Without it those
+	// commands never run.
+	Election *Election
+
+	// Reload, if set, updates the templates whenever it is sent to, without a message being published.
+	Reload chan struct{}
+
+	// Reconfigure, if set, replaces the templates being processed whenever it is sent to. Templates that are unchanged
+	// keep their state, new and changed templates are rendered immediately.
+	Reconfigure chan []Template
+
+	// ForceReload, if set, renders every template and runs every action, even if their output hasn't changed,
+	// whenever it is sent to.
+	ForceReload chan struct{}
+
+	// WatchTemplates causes the template sources to be watched. When a source changes the template is parsed again and
+	// rendered. If the template fails to parse the last good template is kept.
+	WatchTemplates bool
+
+	// ReconnectAttempts is the number of times in a row the subscription is reestablished after failing, before
+	// giving up. When zero the first failure is fatal.
+	ReconnectAttempts int
+
+	// MissingKeyWait is how long a template whose keys are missing on its first render is held, waiting for the keys
+	// to appear, before giving up on it. Held templates are not written and their actions are not run. When zero a
+	// template with missing keys fails immediately.
+	MissingKeyWait time.Duration
+
+	// MissingKeyFallback causes a template that is still missing keys after MissingKeyWait to be rendered with the
+	// missing keys empty, instead of failing.
+	MissingKeyFallback bool
+}
+
+// channel returns the channel to listen for updates on, falling back to RedisTemplateChannel.
+func (cfg Config) channel() string {
+	if cfg.Channel == "" {
+		return RedisTemplateChannel
+	}
+
+	return cfg.Channel
 }
 
 // TemplateFlags is a
@@ -57,9 +125,55 @@ func (t *TemplateFlags) String() string {
 // TemplateFlag denotes a templating action to perform. It has a source, the template to process. A target, the file to
 // write to. And an action, a command to execute once the template has been updated.
 type TemplateFlag struct {
-	Source string
-	Target string
-	Action string
+	Source string `json:"source"`
+	Target string `json:"destination"`
+	Action string `json:"command"`
+
+	// LeftDelimiter and RightDelimiter replace the default "{{" and "}}" delimiters of the template. This is useful
+	// when the file being rendered already uses "{{" and "}}" itself.
+	LeftDelimiter  string `json:"left_delimiter"`
+	RightDelimiter string `json:"right_delimiter"`
+
+	// Strict controls what happens when a template reads a key that doesn't exist. When strict the template fails to
+	// render, otherwise the key is rendered as an empty string. When nil the template is strict.
+	Strict *bool `json:"strict"`
+
+	// Consistent causes the template to be rendered from a consistent snapshot of the keys it reads. If any of the
+	// keys change while the template is rendering, the render is retried.
+	Consistent bool `json:"consistent"`
+
+	// Library is a glob matching template files that are parsed into the template's namespace, so that the templates
+	// they define can be used with {{ template "name" . }}.
+	Library string `json:"template_lib"`
+
+	// DestinationDir is the directory the files written with writeFile are written to. When the source is a glob, each
+	// matching file is rendered into it, named after the source without its ".tmpl" suffix.
+	DestinationDir string `json:"destination_dir"`
+
+	// Prune causes files the template wrote previously, but no longer writes, to be removed.
+	Prune bool `json:"prune"`
+
+	// Rolling, if its max_concurrent is set, limits how many nodes reload the template at once.
+	Rolling RollingConfig `json:"rolling"`
+
+	// RunOn is the nodes the command runs on, RunOnAll or RunOnLeader. Every node writes the outputs either way.
+	RunOn string `json:"run_on"`
+
+	// AllowSecrets allows the output of renders that read secrets to be written to a destination other than a file,
+	// such as stdout or a redis key.
+	AllowSecrets bool `json:"allow_secrets"`
+}
+
+// equal reports whether the two flags describe the same template.
+func (t TemplateFlag) equal(other TemplateFlag) bool {
+	a, b := t, other
+	a.Strict, b.Strict = nil, nil
+	return a == b && t.IsStrict() == other.IsStrict()
+}
+
+// IsStrict reports whether the template fails to render when a key it reads is missing.
+func (t TemplateFlag) IsStrict() bool {
+	return t.Strict == nil || *t.Strict
 }
 
 // String prints the original source of the template flag.
@@ -71,90 +185,150 @@ func (t TemplateFlag) String() string {
 	return fmt.Sprintf("%s:%s:%s", t.Source, t.Target, t.Action)
 }
 
-// makeKeyOrDefault takes a redis pool and returns the keyOrDefault template function.
-func makeKeyOrDefault(p *redis.Pool) func(interface{}, interface{}) (interface{}, error) {
-	return func(keyInterface interface{}, defaultValue interface{}) (interface{}, error) {
-		key, ok := keyInterface.(string)
-		if !ok {
-			return nil, errors.New("invalid argument given to key")
+// Expand expands a template whose source is a glob into a template for each file it matches. The output of each file
+// is written to DestinationDir, named after the file without its ".tmpl" suffix. A template whose source isn't a glob
+// is returned as is, its target defaulting to the same name in DestinationDir.
+func (t TemplateFlag) Expand() ([]TemplateFlag, error) {
+	if !strings.ContainsAny(t.Source, "*?[") {
+		if t.Target == "" && t.DestinationDir != "" {
+			t.Target = t.destination(t.Source)
 		}
 
-		c, err := p.Dial()
-		if err != nil {
-			return nil, err
-		}
+		return []TemplateFlag{t}, nil
+	}
 
-		reply, err := redis.String(c.Do("GET", key))
-		if err != nil {
-			if err == redis.ErrNil {
-				return defaultValue, errors.WithStack(c.Close())
-			}
+	if t.DestinationDir == "" {
+		return nil, errors.Errorf("template %s has a glob source but no destination_dir", t.Source)
+	}
 
-			return nil, err
-		}
+	if t.Target != "" {
+		return nil, errors.Errorf("template %s has a glob source, its destinations are named after the sources", t.Source)
+	}
 
-		if err := c.Close(); err != nil {
-			return nil, err
-		}
+	sources, err := filepath.Glob(t.Source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid template source %s", t.Source)
+	}
 
-		return reply, nil
+	flags := make([]TemplateFlag, len(sources))
+	for i, source := range sources {
+		flags[i] = t
+		flags[i].Source = source
+		flags[i].Target = t.destination(source)
 	}
+
+	return flags, nil
 }
 
-// makeKey takes a redis pool and returns the key template function.
-func makeKey(p *redis.Pool) func(interface{}) (interface{}, error) {
-	return func(argument interface{}) (interface{}, error) {
-		key, ok := argument.(string)
-		if !ok {
-			return nil, errors.New("invalid argument given to key")
-		}
+// destination returns the path in DestinationDir that the source is rendered to.
+func (t TemplateFlag) destination(source string) string {
+	return filepath.Join(t.DestinationDir, strings.TrimSuffix(filepath.Base(source), ".tmpl"))
+}
 
-		c, err := p.Dial()
-		if err != nil {
-			return nil, err
+// ToTemplate creates a Template from the given redis pool.
+func (t TemplateFlag) ToTemplate(p *redis.Pool) (Template, error) {
+	sourceContents, err := ioutil.ReadFile(t.Source)
+	if err != nil {
+		return Template{}, err
+	}
+
+	missingKey := "missingkey=zero"
+	if t.IsStrict() {
+		missingKey = "missingkey=error"
+	}
+
+	temp, err := template.New(t.Source).
+		Delims(t.LeftDelimiter, t.RightDelimiter).
+		Option(missingKey).
+		Funcs((&render{}).funcMap()).
+		Parse(string(sourceContents))
+	if err != nil {
+		return Template{}, err
+	}
+
+	// the library is parsed into the template's namespace. Its contents are recorded along with the source so that
+	// changes to the library are noticed when the configuration is reloaded.
+	source := bytes.NewBuffer(sourceContents)
+	libraryFiles, err := t.libraryFiles()
+	if err != nil {
+		return Template{}, err
+	}
+
+	for _, file := range libraryFiles {
+		// a library glob may match the template itself, which mustn't be redefined.
+		if filepath.Clean(file) == filepath.Clean(t.Source) {
+			continue
 		}
 
-		reply, err := redis.String(c.Do("GET", key))
+		contents, err := ioutil.ReadFile(file)
 		if err != nil {
-			return nil, err
+			return Template{}, errors.WithStack(err)
 		}
 
-		if err := c.Close(); err != nil {
-			return nil, err
+		if _, err := temp.New(file).Parse(string(contents)); err != nil {
+			return Template{}, errors.WithStack(err)
 		}
 
-		return reply, nil
+		fmt.Fprintf(source, "\x00%s\x00%s", file, contents)
 	}
-}
 
-// ToTemplate creates a Template from the given redis pool.
-func (t TemplateFlag) ToTemplate(p *redis.Pool) (Template, error) {
-	sourceContents, err := ioutil.ReadFile(t.Source)
+	sink, err := ParseSink(t.Target, p)
 	if err != nil {
 		return Template{}, err
 	}
 
-	temp, err := template.New(t.Source).Funcs(template.FuncMap{
-		"keyOrDefault": makeKeyOrDefault(p),
-		"key":          makeKey(p),
-	}).Parse(string(sourceContents))
-	if err != nil {
-		return Template{}, err
+	if err := t.Rolling.validate(); err != nil {
+		return Template{}, errors.Wrapf(err, "invalid rolling config of template %s", t.Source)
+	}
+
+	if t.RunOn != "" && t.RunOn != RunOnAll && t.RunOn != RunOnLeader {
+		return Template{}, errors.Errorf("invalid run_on %s, expected %s or %s", t.RunOn, RunOnAll, RunOnLeader)
 	}
 
+	state := &templateState{}
 	return Template{
 		SourceTemplate: temp,
 		Target:         &t.Target,
+		Sink:           sink,
+		Strict:         t.IsStrict(),
+		Consistent:     t.Consistent,
+		AllowSecrets:   t.AllowSecrets,
+		pool:           p,
+		state:          state,
+		flag:           t,
+		source:         source.String(),
+		libraryFiles:   libraryFiles,
+
+		// the command is run with the environment variables given to executeWith added to its environment.
 		Action: func() error {
 			cmd := exec.Command("sh", "-c", t.Action)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
+			if env := state.getCommandEnv(); env != nil {
+				cmd.Env = append(os.Environ(), env...)
+			}
+
 			err := cmd.Run()
 			return errors.WithStack(err)
 		},
 	}, nil
 }
 
+// libraryFiles returns the files matched by the template's library glob, in a stable order.
+func (t TemplateFlag) libraryFiles() ([]string, error) {
+	if t.Library == "" {
+		return nil, nil
+	}
+
+	files, err := filepath.Glob(t.Library)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid template library %s", t.Library)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
 // ParseTemplateFlag parses Templates from strings.
 func ParseTemplateFlag(input string) (TemplateFlag, error) {
 	firstColon := strings.IndexRune(input, ':')
@@ -162,32 +336,155 @@ func ParseTemplateFlag(input string) (TemplateFlag, error) {
 		return TemplateFlag{}, errors.New("invalid template given")
 	}
 
-	secondColon := strings.IndexRune(input[firstColon+1:], ':')
+	source, rest := input[0:firstColon], input[firstColon+1:]
+
+	secondColon := targetEnd(rest)
 	if secondColon == -1 {
 		return TemplateFlag{
-			Source: input[0:firstColon],
-			Target: input[firstColon+1:],
+			Source: source,
+			Target: rest,
 		}, nil
 	}
 
-	secondColon += firstColon + 1
-
 	return TemplateFlag{
-		Source: input[0:firstColon],
-		Target: input[firstColon+1 : secondColon],
-		Action: input[secondColon+1:],
+		Source: source,
+		Target: rest[0:secondColon],
+		Action: rest[secondColon+1:],
 	}, nil
 }
 
+// sinkSchemes are the schemes of the targets that are urls. The colons in their scheme, and in the host of http urls,
+// don't end the target.
+var sinkSchemes = []string{"http://", "https://"}
+
+// targetEnd returns the index of the colon ending the target at the start of the input, or -1 if the whole input is
+// the target. Redis keys are usually separated by colons, so a redis target is always the rest of the input.
+func targetEnd(input string) int {
+	if strings.HasPrefix(input, "redis://") {
+		return -1
+	}
+
+	start := 0
+	for _, scheme := range sinkSchemes {
+		if !strings.HasPrefix(input, scheme) {
+			continue
+		}
+
+		start = len(scheme)
+		if slash := strings.IndexRune(input[start:], '/'); slash != -1 {
+			start += slash
+		}
+
+		break
+	}
+
+	end := strings.IndexRune(input[start:], ':')
+	if end == -1 {
+		return -1
+	}
+
+	return start + end
+}
+
 // Template is a processed version of a TemplateFlag. Instead of having a path to a
 // source, it has the contents of the source. Otherwise it is the same as a TemplateFlag.
 type Template struct {
 	SourceTemplate *template.Template
 	Target         *string
 	Action         func() error
+
+	// Sink, if set, is where the output of the template is written, instead of the file at Target.
+	Sink Sink
+
+	// Strict causes the template to fail to render when it reads keys that don't exist.
+	Strict bool
+
+	// Consistent causes the template to be rendered from a consistent snapshot of the keys it reads.
+	Consistent bool
+
+	// KeyPrefixes, if set, are the prefixes that the keys the template reads are looked up under, in order. A key
+	// resolves to its value under the first prefix it exists under, and ls lists the keys under every prefix.
+	KeyPrefixes []string
+
+	// SecretKey, if set, decrypts the keys the template reads with secret.
+	SecretKey *SecretKey
+
+	// AllowSecrets allows the output of renders that read secrets to be written to a Sink other than a FileSink. Without
+	// it those renders fail, so that secrets aren't written where they may be seen.
+	AllowSecrets bool
+
+	pool  *redis.Pool
+	state *templateState
+
+	// flag and source are what the template was built from, they are used to tell whether a template has changed
+	// when the configuration is reloaded.
+	flag   TemplateFlag
+	source string
+
+	// libraryFiles are the files of the template library that were parsed into the template.
+	libraryFiles []string
+}
+
+// files returns the files the template is built from, and the files it included in its last render.
+func (t Template) files() []string {
+	files := append([]string{t.flag.Source}, t.libraryFiles...)
+	return append(files, t.state.getIncluded()...)
+}
+
+// uses reports whether the template is built from, or includes, the file at the given absolute path.
+func (t Template) uses(path string) bool {
+	for _, file := range t.files() {
+		if abs, err := filepath.Abs(file); err == nil && abs == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reparse rebuilds the template from its source, keeping its action, sink, key prefixes, secret key and state.
+func (t Template) reparse() (Template, error) {
+	template, err := t.flag.ToTemplate(t.pool)
+	if err != nil {
+		return t, err
+	}
+
+	template.Action = t.Action
+	template.Sink = t.Sink
+	template.KeyPrefixes = t.KeyPrefixes
+	template.SecretKey = t.SecretKey
+	template.state = t.state
+	return template, nil
+}
+
+// unchanged reports whether the two templates were built from the same flag and source, and look keys up under the
+// same prefixes with the same secret key.
+func (t Template) unchanged(other Template) bool {
+	return t.flag.equal(other.flag) && t.source == other.source && equalStrings(t.KeyPrefixes, other.KeyPrefixes) &&
+		t.SecretKey.equal(other.SecretKey)
+}
+
+// RunsOnLeader reports whether the template's command only runs on the elected leader.
+func (t Template) RunsOnLeader() bool {
+	return t.flag.RunOn == RunOnLeader
+}
+
+// commandPending reports whether the template's command was skipped while another node led, and this node now leads.
+func (t Template) commandPending(election *Election) bool {
+	_, leads := election.Leader()
+	return leads && t.state.isCommandSkipped()
 }
 
 // Execute executes the command
 func (t Template) Execute() error {
 	return errors.WithStack(t.Action())
 }
+
+// executeWith executes the command with the environment variables added to its environment. The variables are only
+// seen by the Action built from the template's command, an Action that replaced it is called as it is.
+func (t Template) executeWith(env []string) error {
+	t.state.setCommandEnv(env)
+	defer t.state.setCommandEnv(nil)
+
+	return t.Execute()
+}
@@ -1,6 +1,10 @@
 package pkg
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -72,6 +76,31 @@ var parserTestCases = []struct {
 			Action: "/app/update.sh",
 		},
 	},
+	{
+		Name:  "http target with a port, and action",
+		Input: "/app/routes.tmpl:http://localhost:8080/reload:/app/update.sh",
+		Template: TemplateFlag{
+			Source: "/app/routes.tmpl",
+			Target: "http://localhost:8080/reload",
+			Action: "/app/update.sh",
+		},
+	},
+	{
+		Name:  "redis target",
+		Input: "/app/routes.tmpl:redis://routes",
+		Template: TemplateFlag{
+			Source: "/app/routes.tmpl",
+			Target: "redis://routes",
+		},
+	},
+	{
+		Name:  "redis target with a colon separated key",
+		Input: "/app/a.tmpl:redis://derived:app:config",
+		Template: TemplateFlag{
+			Source: "/app/a.tmpl",
+			Target: "redis://derived:app:config",
+		},
+	},
 }
 
 func TestParser(t *testing.T) {
@@ -153,3 +182,132 @@ func TestTemplateFlags_String(t *testing.T) {
 
 	assert.NotEmpty(t, flags.String())
 }
+
+func TestTemplateFlag_IsStrict(t *testing.T) {
+	strict, lenient := true, false
+
+	assert.True(t, TemplateFlag{}.IsStrict())
+	assert.True(t, TemplateFlag{Strict: &strict}.IsStrict())
+	assert.False(t, TemplateFlag{Strict: &lenient}.IsStrict())
+}
+
+func TestTemplateFlag_ToTemplateDelimiters(t *testing.T) {
+	const TestTemplate = "./test_files/delimiters.tmpl"
+
+	err := ioutil.WriteFile(TestTemplate, []byte(`{{ name | upper }}: [[key "foo"]]`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = TemplateFlag{Source: TestTemplate}.ToTemplate(nil)
+	assert.NotNil(t, err, "the default delimiters should fail to parse jinja syntax")
+
+	_, err = TemplateFlag{
+		Source:         TestTemplate,
+		LeftDelimiter:  "[[",
+		RightDelimiter: "]]",
+	}.ToTemplate(nil)
+	assert.Nil(t, err)
+}
+
+func TestTemplateFlag_Equal(t *testing.T) {
+	strict, alsoStrict, lenient := true, true, false
+
+	flag := TemplateFlag{Source: "foo", Target: "bar", Strict: &strict}
+	assert.True(t, flag.equal(TemplateFlag{Source: "foo", Target: "bar", Strict: &alsoStrict}))
+	assert.True(t, flag.equal(TemplateFlag{Source: "foo", Target: "bar"}))
+	assert.False(t, flag.equal(TemplateFlag{Source: "foo", Target: "bar", Strict: &lenient}))
+	assert.False(t, flag.equal(TemplateFlag{Source: "foo", Target: "baz", Strict: &strict}))
+}
+
+func TestTemplate_Unchanged(t *testing.T) {
+	const TestTemplate = "./test_files/unchanged.tmpl"
+
+	if err := ioutil.WriteFile(TestTemplate, []byte(`{{key "foo"}}`), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	flag := TemplateFlag{Source: TestTemplate, Target: "bar"}
+	first, err := flag.ToTemplate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := flag.ToTemplate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, first.unchanged(second))
+
+	if err := ioutil.WriteFile(TestTemplate, []byte(`{{key "bar"}}`), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	third, err := flag.ToTemplate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, first.unchanged(third))
+}
+
+func TestTemplateFlag_ToTemplateLibrary(t *testing.T) {
+	const TestTemplate = "./test_files/library.tmpl"
+	const TestLibrary = "./test_files/library.lib"
+
+	err := ioutil.WriteFile(TestTemplate, []byte(`server { {{ template "tls_block" }} }`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(TestLibrary, []byte(`{{ define "tls_block" }}ssl on;{{ end }}`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template, err := TemplateFlag{Source: TestTemplate, Library: "./test_files/*.lib"}.ToTemplate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, template.files(), "test_files/library.lib")
+
+	buffer := bytes.NewBuffer(nil)
+	if err := template.SourceTemplate.Execute(buffer, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "server { ssl on; }", buffer.String())
+}
+
+func TestTemplateFlag_Expand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.conf.tmpl", "b.conf.tmpl", "c.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flags, err := TemplateFlag{Source: filepath.Join(dir, "*.tmpl"), DestinationDir: "/etc/app/conf.d"}.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []TemplateFlag{
+		{Source: filepath.Join(dir, "a.conf.tmpl"), Target: "/etc/app/conf.d/a.conf", DestinationDir: "/etc/app/conf.d"},
+		{Source: filepath.Join(dir, "b.conf.tmpl"), Target: "/etc/app/conf.d/b.conf", DestinationDir: "/etc/app/conf.d"},
+	}, flags)
+
+	flags, err = TemplateFlag{Source: "/tmpl/app.conf", Target: "/etc/app.conf"}.Expand()
+	assert.Nil(t, err)
+	assert.Equal(t, []TemplateFlag{{Source: "/tmpl/app.conf", Target: "/etc/app.conf"}}, flags)
+
+	_, err = TemplateFlag{Source: filepath.Join(dir, "*.tmpl")}.Expand()
+	assert.NotNil(t, err, "a glob source needs a destination directory")
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// OutputDiff is the difference between a file a template would write and the file as it is.
+type OutputDiff struct {
+	// Path is the path of the file.
+	Path string
+
+	// Exists is false if the file doesn't exist yet.
+	Exists bool
+
+	Current  string
+	Rendered string
+}
+
+// Changed reports whether rendering the template would change the file.
+func (d OutputDiff) Changed() bool {
+	return !d.Exists || d.Current != d.Rendered
+}
+
+// Unified returns the change to the file as a unified diff. It is empty if the file wouldn't change.
+func (d OutputDiff) Unified() (string, error) {
+	if !d.Changed() {
+		return "", nil
+	}
+
+	from := d.Path
+	if !d.Exists {
+		from = os.DevNull
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(d.Current),
+		B:        splitLines(d.Rendered),
+		FromFile: from,
+		ToFile:   d.Path,
+		Context:  3,
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// a new empty file has no lines to show.
+	if diff == "" {
+		diff = "--- " + from + "\n+++ " + d.Path + "\n"
+	}
+
+	return diff, nil
+}
+
+// Diff renders the template against the keys in redis, reading the overlay values instead of the keys they are given
+// for, and returns the differences between the files it would write and the files as they are. The overlay keys are
+// looked up under the template's key prefixes as the keys it reads are, taking precedence over every prefix. Nothing is
+// written, and outputs that aren't files, such as redis or http destinations, aren't compared. The secrets the
+// template reads are redacted from the files.
+func (t Template) Diff(overlay map[string]Value) ([]OutputDiff, error) {
+	buffer := bytes.NewBuffer(nil)
+	result, err := t.renderWith(buffer, renderOptions{overlay: layerOverlay(t.KeyPrefixes, overlay)})
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []OutputDiff
+	output := buffer.Bytes()
+	if sink, ok := t.sink().(*FileSink); ok && (len(result.files) == 0 || len(bytes.TrimSpace(output)) > 0) {
+		diff, err := diffFile(sink.Path, string(output))
+		if err != nil {
+			return nil, err
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	dir := t.outputDir()
+	if len(result.files) > 0 && dir == "" {
+		return nil, errors.Errorf("template %s writes files but has no destination", t.SourceTemplate.Name())
+	}
+
+	for _, file := range result.files {
+		diff, err := diffFile(filepath.Join(dir, file.name), file.contents)
+		if err != nil {
+			return nil, err
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	for i := range diffs {
+		diffs[i].Current = redactSecrets(diffs[i].Current, result.secrets)
+		diffs[i].Rendered = redactSecrets(diffs[i].Rendered, result.secrets)
+	}
+
+	return diffs, nil
+}
+
+// splitLines splits the text into lines for diffing, each ending with a newline, including the last.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// diffFile compares the rendered contents to the file at the path.
+func diffFile(path string, rendered string) (OutputDiff, error) {
+	diff := OutputDiff{Path: path, Rendered: rendered}
+
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return diff, nil
+	}
+
+	if err != nil {
+		return OutputDiff{}, errors.WithStack(err)
+	}
+
+	diff.Exists = true
+	diff.Current = string(current)
+	return diff, nil
+}
@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputDiff_Unified(t *testing.T) {
+	diff := OutputDiff{Path: "app.conf", Exists: true, Current: "host 10.0.0.1\nport 80\n", Rendered: "host 10.0.0.2\nport 80\n"}
+	assert.True(t, diff.Changed())
+
+	unified, err := diff.Unified()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "--- app.conf\n+++ app.conf\n@@ -1,2 +1,2 @@\n-host 10.0.0.1\n+host 10.0.0.2\n port 80\n", unified)
+
+	unified, err = OutputDiff{Path: "app.conf", Rendered: "port 80\n"}.Unified()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "--- /dev/null\n+++ app.conf\n@@ -0,0 +1 @@\n+port 80\n", unified)
+
+	unchanged := OutputDiff{Path: "app.conf", Exists: true, Current: "port 80\n", Rendered: "port 80\n"}
+	assert.False(t, unchanged.Changed())
+
+	unified, err = unchanged.Unified()
+	assert.NoError(t, err)
+	assert.Empty(t, unified)
+}
+
+func TestTemplate_DiffOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "app.tmpl")
+	err = ioutil.WriteFile(source, []byte(`host {{ key "db:host" }}
+{{ range $name, $root := hash "vhosts" }}{{ writeFile $name $root }}{{ end }}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(target, []byte("host 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// every key is overlaid, so redis is never read.
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("redis is unavailable") }}
+	template, err := TemplateFlag{Source: source, Target: target}.ToTemplate(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := template.Diff(map[string]Value{
+		"db:host": *StringValue("10.0.0.2"),
+		"vhosts":  {Type: TypeHash, Fields: map[string]string{"example.com": "/srv/example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []OutputDiff{
+		{Path: target, Exists: true, Current: "host 10.0.0.1\n", Rendered: "host 10.0.0.2\n"},
+		{Path: filepath.Join(dir, "example.com"), Rendered: "/srv/example.com"},
+	}, diffs)
+
+	// nothing is written.
+	contents, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "host 10.0.0.1\n", string(contents))
+	_, err = os.Stat(filepath.Join(dir, "example.com"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = template.Diff(map[string]Value{"db:host": {Type: TypeList}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Export returns the values of the keys under the prefix. Keys of types that can't be exported, such as the streams
+// recording the history of keys, are skipped. An empty prefix exports every key.
+func Export(p *redis.Pool, prefix string) (map[string]Value, error) {
+	c := p.Get()
+	defer c.Close()
+
+	// the prefix is scanned as a namespace, so that exporting app doesn't export apple.
+	if prefix != "" && !strings.HasSuffix(prefix, KeySeparator) {
+		prefix += KeySeparator
+	}
+
+	keys, err := scanKeys(c.Do, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var exported []string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, HistoryPrefix) {
+			exported = append(exported, key)
+		}
+	}
+
+	return exportKeys(c, exported, true)
+}
+
+// ExportKeys returns the values of the keys. Keys that don't exist are skipped.
+func ExportKeys(p *redis.Pool, keys []string) (map[string]Value, error) {
+	c := p.Get()
+	defer c.Close()
+
+	return exportKeys(c, keys, false)
+}
+
+// exportKeys reads the values of the keys. Keys of types that can't be exported are skipped if skipUnsupported is
+// set, and are errors otherwise.
+func exportKeys(c redis.Conn, keys []string, skipUnsupported bool) (map[string]Value, error) {
+	values := make(map[string]Value, len(keys))
+	for _, key := range keys {
+		valueType, err := redis.String(c.Do("TYPE", key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get the type of key %s", key)
+		}
+
+		if skipUnsupported && !exportable(valueType) {
+			continue
+		}
+
+		value, err := readTypedValue(c, key, valueType)
+		if err != nil {
+			return nil, err
+		}
+
+		if value != nil {
+			values[key] = *value
+		}
+	}
+
+	return values, nil
+}
+
+// exportable reports whether keys of the type can be exported.
+func exportable(valueType string) bool {
+	switch valueType {
+	case TypeString, TypeHash, TypeList, TypeSet, TypeZSet:
+		return true
+	}
+
+	return false
+}
+
+// ExportTemplateKeys returns the values of the keys the templates are known to read, and of the keys under the
+// prefixes they list. Keys are exported under each of the templates' key prefixes they exist under.
+func ExportTemplateKeys(p *redis.Pool, templates []Template) (map[string]Value, error) {
+	keys := map[string]bool{}
+	for _, template := range templates {
+		references := template.References()
+		for _, key := range references.Keys {
+			for _, layer := range layerKeys(template.KeyPrefixes, key) {
+				keys[layer] = true
+			}
+		}
+
+		for _, prefix := range references.Prefixes {
+			for _, layer := range layerKeys(template.KeyPrefixes, prefix) {
+				c := p.Get()
+				listed, err := scanKeys(c.Do, layer)
+				c.Close()
+				if err != nil {
+					return nil, err
+				}
+
+				for _, key := range listed {
+					keys[key] = true
+				}
+			}
+		}
+	}
+
+	return ExportKeys(p, sortedKeys(keys))
+}
+
+// EncodeValues encodes the values in the given format, so that they can be imported again. The prefix is removed
+// from the keys, so that the same prefix, or another one, can be given when importing them. Values that aren't
+// strings are written as an object giving their $type and $value, which the env format can't represent.
+func EncodeValues(values map[string]Value, prefix string, format string) ([]byte, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, KeySeparator) {
+		prefix += KeySeparator
+	}
+
+	documents := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if format == FormatEnv && value.Type != TypeString {
+			return nil, errors.Errorf("key %s is a %s, which can't be exported as env", key, value.Type)
+		}
+
+		documents[strings.TrimPrefix(key, prefix)] = value.document()
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	switch format {
+	case FormatJSON:
+		encoded, err := json.MarshalIndent(documents, "", "  ")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		buffer.Write(encoded)
+		buffer.WriteString("\n")
+	case FormatYAML:
+		encoded, err := yaml.Marshal(yamlDocument(documents))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		buffer.Write(encoded)
+	case FormatEnv:
+		for _, key := range sortedDocumentKeys(documents) {
+			fmt.Fprintf(buffer, "%s=%s\n", key, quoteString(documents[key].(string)))
+		}
+	default:
+		return nil, errors.Errorf("unknown format %s", format)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// sortedDocumentKeys returns the keys of the object in sorted order.
+func sortedDocumentKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// quoteString quotes the string as a json string, which is also a valid double quoted dotenv string.
+func quoteString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// yamlDocument returns the document with its json numbers converted to floats, as yaml writes json numbers as strings.
+func yamlDocument(document interface{}) interface{} {
+	switch v := document.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			converted[key] = yamlDocument(value)
+		}
+
+		return converted
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	}
+
+	return document
+}
@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeValues_JSON(t *testing.T) {
+	encoded, err := EncodeValues(map[string]Value{
+		"app:db:host": *StringValue("10.0.0.2"),
+		"app:vhosts":  {Type: TypeSet, Members: []string{"b.com", "a.com"}},
+	}, "app", FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{
+  "db:host": "10.0.0.2",
+  "vhosts": {
+    "$type": "set",
+    "$value": [
+      "a.com",
+      "b.com"
+    ]
+  }
+}
+`, string(encoded))
+}
+
+func TestEncodeValues_YAML(t *testing.T) {
+	values := map[string]Value{
+		"db:host":  *StringValue("true"),
+		"db:port":  *StringValue("5432"),
+		"servers":  {Type: TypeList, Members: []string{"web1", "web2"}},
+		"tls":      {Type: TypeHash, Fields: map[string]string{"cert": "/etc/tls.crt"}},
+		"weights":  {Type: TypeZSet, Scores: map[string]float64{"web1": 1.5}},
+		"empty":    {Type: TypeHash},
+		"multiple": *StringValue("a\nb"),
+	}
+
+	encoded, err := EncodeValues(values, "", FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `db:host: "true"
+db:port: "5432"
+empty:
+  $type: hash
+  $value: {}
+multiple: |-
+  a
+  b
+servers:
+  $type: list
+  $value:
+  - web1
+  - web2
+tls:
+  $type: hash
+  $value:
+    cert: /etc/tls.crt
+weights:
+  $type: zset
+  $value:
+    web1: 1.5
+`, string(encoded))
+
+	// the exported document must import the same values.
+	parsed, err := ParseValues(encoded, FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flattened, err := FlattenValues("", parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, flattened, len(values))
+	for key, value := range values {
+		assert.True(t, value.equal(flattened[key]), key)
+	}
+}
+
+// TestEncodeValues_YAMLRoundTrip tests that strings yaml would read as other types, or that need quoting, are imported
+// as they were exported.
+func TestEncodeValues_YAMLRoundTrip(t *testing.T) {
+	values := map[string]Value{}
+	for i, s := range []string{"yes", "off", "~", "null", "1e3", "0x1F", "- item", "a: b", " padded ", "#comment",
+		`it's "quoted"`, "tab\there", "trailing\n", "{a: 1}", "[a, b]", "&anchor", "*alias", "!tag", "", "2001-12-14"} {
+		values[fmt.Sprintf("key%d", i)] = *StringValue(s)
+	}
+
+	encoded, err := EncodeValues(values, "", FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseValues(encoded, FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flattened, err := FlattenValues("", parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, values, flattened)
+}
+
+func TestEncodeValues_Env(t *testing.T) {
+	encoded, err := EncodeValues(map[string]Value{
+		"app:DB_HOST":  *StringValue("10.0.0.2"),
+		"app:GREETING": *StringValue(`say "hi"`),
+	}, "app:", FormatEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "DB_HOST=\"10.0.0.2\"\nGREETING=\"say \\\"hi\\\"\"\n", string(encoded))
+
+	parsed, err := ParseValues(encoded, FormatEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{"DB_HOST": "10.0.0.2", "GREETING": `say "hi"`}, parsed)
+
+	_, err = EncodeValues(map[string]Value{"servers": {Type: TypeList}}, "", FormatEnv)
+	assert.Error(t, err)
+
+	_, err = EncodeValues(nil, "", "toml")
+	assert.Error(t, err)
+}
+
+func TestTemplate_References(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "app.tmpl")
+	err = ioutil.WriteFile(source, []byte(`
+{{ key "db:host" }}:{{ keyOrDefault "db:port" "5432" }}
+{{ if key "feature:tls" }}{{ range $name, $value := hash "tls" }}{{ $name }}{{ end }}{{ end }}
+{{ range ls "vhosts:" }}{{ key (printf "vhosts:%s" .) }}{{ end }}
+{{ template "footer" }}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "footer.lib"), []byte(`{{ define "footer" }}{{ key "footer" }}{{ end }}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template, err := TemplateFlag{Source: source, Library: filepath.Join(dir, "*.lib")}.ToTemplate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, TemplateReferences{
+		Keys:      []string{"db:host", "db:port", "feature:tls", "footer", "tls"},
+		Defaulted: []string{"db:port"},
+		Prefixes:  []string{"vhosts:"},
+	}, template.References())
+}
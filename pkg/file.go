@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// FileConfig is the format of the configuration file given with the -config flag. It allows settings to be given
+// that are too awkward to express in a single -template flag.
+type FileConfig struct {
+	// Strict is the default strictness of the templates. Templates that set their own strictness override it.
+	Strict *bool `json:"strict"`
+
+	// TemplateLib is a glob matching template files that are parsed into every template's namespace. Templates that
+	// set their own library override it.
+	TemplateLib string `json:"template_lib"`
+
+	// KeyPrefixes are the prefixes that keys are looked up under, in order. They are overridden by -key-prefix.
+	KeyPrefixes []string `json:"key_prefixes"`
+
+	// Templates are additional templates to process, on top of any given on the command line.
+	Templates []TemplateFlag `json:"templates"`
+
+	// Unsupported are the settings in the file that aren't any of the above, and so are ignored.
+	Unsupported []string `json:"-"`
+}
+
+// LoadFileConfig reads and parses the configuration file at the given path.
+func LoadFileConfig(path string) (FileConfig, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return FileConfig{}, errors.WithStack(err)
+	}
+
+	var cfg FileConfig
+	if err := json.Unmarshal(contents, &cfg); err != nil {
+		return FileConfig{}, errors.Wrapf(err, "failed to parse config file %s", path)
+	}
+
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &settings); err != nil {
+		return FileConfig{}, errors.Wrapf(err, "failed to parse config file %s", path)
+	}
+
+	for setting := range settings {
+		switch setting {
+		case "strict", "template_lib", "key_prefixes", "templates":
+		default:
+			cfg.Unsupported = append(cfg.Unsupported, setting)
+		}
+	}
+
+	sort.Strings(cfg.Unsupported)
+	return cfg, nil
+}
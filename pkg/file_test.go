@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFileConfig(t *testing.T) {
+	const TestConfig = "./test_files/config.json"
+
+	err := ioutil.WriteFile(TestConfig, []byte(`{
+	"strict": false,
+	"templates": [{
+		"source": "/app/chart.yaml.tmpl",
+		"destination": "/app/chart.yaml",
+		"command": "helm upgrade",
+		"left_delimiter": "[[",
+		"right_delimiter": "]]",
+		"strict": true
+	}]
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadFileConfig(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, cfg.Unsupported)
+	if assert.NotNil(t, cfg.Strict) {
+		assert.False(t, *cfg.Strict)
+	}
+
+	if assert.Len(t, cfg.Templates, 1) {
+		tmpl := cfg.Templates[0]
+		assert.Equal(t, "/app/chart.yaml.tmpl", tmpl.Source)
+		assert.Equal(t, "/app/chart.yaml", tmpl.Target)
+		assert.Equal(t, "helm upgrade", tmpl.Action)
+		assert.Equal(t, "[[", tmpl.LeftDelimiter)
+		assert.Equal(t, "]]", tmpl.RightDelimiter)
+		assert.True(t, tmpl.IsStrict())
+	}
+
+	_, err = LoadFileConfig("./test_files/missing.json")
+	assert.NotNil(t, err)
+}
+
+func TestLoadFileConfig_Unsupported(t *testing.T) {
+	const TestConfig = "./test_files/unsupported.json"
+
+	err := ioutil.WriteFile(TestConfig, []byte(`{"strict": true, "splay": "5s", "redis_chan": "updates"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadFileConfig(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"redis_chan", "splay"}, cfg.Unsupported)
+}
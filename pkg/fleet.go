@@ -0,0 +1,380 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// FleetPrefix is the prefix of the hashes that nodes report the state of their templates in. It is followed by the
+// name of the node.
+const FleetPrefix = "redis-template:nodes:"
+
+// GenerationKey is incremented whenever redis-template publishes a change, so that the nodes that haven't rendered the
+// latest change can be found.
+const GenerationKey = "redis-template:generation"
+
+// The states of a node, as reported by FleetStatus.
+const (
+	// NodeUpToDate is a node that has rendered the latest change without errors.
+	NodeUpToDate = "up-to-date"
+
+	// NodeStale is a node that hasn't rendered the latest change yet.
+	NodeStale = "stale"
+
+	// NodeFailing is a node whose last render or command failed.
+	NodeFailing = "failing"
+)
+
+// the fields of a node's hash. Each template is reported in a field named after it, following templateFieldPrefix.
+const (
+	generationField     = "generation"
+	updatedField        = "updated"
+	heartbeatField      = "heartbeat"
+	templateFieldPrefix = "template:"
+)
+
+// Fleet reports the state of this node's templates to redis after every update, and keeps the report alive with a
+// heartbeat, so that the state of every node can be seen with FleetStatus. The report expires if the node stops
+// sending heartbeats. A nil *Fleet reports nothing.
+type Fleet struct {
+	// Node is the name the node reports under, e.g. its hostname.
+	Node string
+
+	// TTL is how long the report lives without a heartbeat. Heartbeats are sent at a third of it.
+	TTL time.Duration
+
+	mut sync.Mutex
+
+	// generation is the generation of the last completed update, and pending is the generation of the update in
+	// progress, which is reported once it completes.
+	generation int64
+	pending    int64
+	updated    time.Time
+	templates  map[string]*NodeTemplate
+}
+
+// NodeTemplate is the state of a template on a node.
+type NodeTemplate struct {
+	Name       string     `json:"name"`
+	Target     string     `json:"target,omitempty"`
+	OutputHash string     `json:"output_hash,omitempty"`
+	Rendered   *time.Time `json:"rendered,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// failing reports whether the template's last render or command failed.
+func (t NodeTemplate) failing() bool {
+	return t.Error != "" || (t.ExitCode != nil && *t.ExitCode != 0)
+}
+
+// NodeStatus is the state of a node, as reported by FleetStatus.
+type NodeStatus struct {
+	Node string `json:"node"`
+
+	// State is NodeUpToDate, NodeStale or NodeFailing.
+	State string `json:"state"`
+
+	// Generation is the value of GenerationKey when the node last updated.
+	Generation int64     `json:"generation"`
+	Updated    time.Time `json:"updated"`
+	Heartbeat  time.Time `json:"heartbeat"`
+
+	Templates []NodeTemplate `json:"templates"`
+}
+
+// FleetReport is the state of every node that is reporting.
+type FleetReport struct {
+	// Generation is the value of GenerationKey, counting the changes that have been published.
+	Generation int64        `json:"generation"`
+	Nodes      []NodeStatus `json:"nodes"`
+
+	// Leader, if set, is the leader of the election the nodes run their run_on leader commands in.
+	Leader *LeaderStatus `json:"leader,omitempty"`
+}
+
+// NewFleet creates a Fleet reporting under the node name, whose reports expire after the ttl without a heartbeat.
+func NewFleet(node string, ttl time.Duration) *Fleet {
+	return &Fleet{Node: node, TTL: ttl, templates: map[string]*NodeTemplate{}}
+}
+
+// heartbeatInterval is how often the report is refreshed.
+func (f *Fleet) heartbeatInterval() time.Duration {
+	if f.TTL/3 < minPingInterval {
+		return minPingInterval
+	}
+
+	return f.TTL / 3
+}
+
+// setTemplates sets the templates being reported. The state of templates that were already being reported is kept.
+func (f *Fleet) setTemplates(templates []Template) {
+	if f == nil {
+		return
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	records := make(map[string]*NodeTemplate, len(templates))
+	for _, template := range templates {
+		name := template.SourceTemplate.Name()
+		record, ok := f.templates[name]
+		if !ok {
+			record = &NodeTemplate{Name: name}
+		}
+
+		if template.Target != nil {
+			record.Target = *template.Target
+		}
+
+		records[name] = record
+	}
+
+	f.templates = records
+}
+
+// beginUpdate records the generation the update renders. It is read before the templates are rendered, so the
+// renders include at least the changes it counts. It is only reported once the update completes, so heartbeats sent
+// during the update report the generation of the last completed update.
+func (f *Fleet) beginUpdate(p *redis.Pool) error {
+	if f == nil {
+		return nil
+	}
+
+	c := p.Get()
+	defer c.Close()
+
+	generation, err := getGeneration(c)
+	if err != nil {
+		return err
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.pending = generation
+	return nil
+}
+
+// record calls fn with the template's record, if the template is being reported.
+func (f *Fleet) record(name string, fn func(*NodeTemplate)) {
+	if f == nil {
+		return
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if record, ok := f.templates[name]; ok {
+		fn(record)
+	}
+}
+
+// templateRendered records that the template rendered the output.
+func (f *Fleet) templateRendered(name string, output []byte) {
+	f.record(name, func(record *NodeTemplate) {
+		now := time.Now()
+		record.Rendered = &now
+		record.OutputHash = fmt.Sprintf("%x", sha256.Sum256(output))
+		record.Error = ""
+	})
+}
+
+// renderFailed records that the template failed to render.
+func (f *Fleet) renderFailed(name string, err error) {
+	f.record(name, func(record *NodeTemplate) {
+		record.Error = err.Error()
+	})
+}
+
+// commandCompleted records a run of the template's command.
+func (f *Fleet) commandCompleted(name string, err error) {
+	f.record(name, func(record *NodeTemplate) {
+		code := exitCode(err)
+		record.ExitCode = &code
+		if err != nil {
+			record.Error = err.Error()
+		}
+	})
+}
+
+// report writes the node's report, replacing the previous one. If updated is set the report records that an update
+// has just completed, otherwise it is a heartbeat.
+func (f *Fleet) report(p *redis.Pool, updated bool) error {
+	if f == nil {
+		return nil
+	}
+
+	f.mut.Lock()
+	now := time.Now()
+	if updated {
+		f.updated = now
+		f.generation = f.pending
+	}
+
+	args := redis.Args{FleetPrefix + f.Node,
+		generationField, f.generation,
+		updatedField, f.updated.Format(time.RFC3339Nano),
+		heartbeatField, now.Format(time.RFC3339Nano),
+	}
+
+	for name, record := range f.templates {
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			f.mut.Unlock()
+			return errors.WithStack(err)
+		}
+
+		args = args.Add(templateFieldPrefix+name, encoded)
+	}
+	f.mut.Unlock()
+
+	c := p.Get()
+	defer c.Close()
+
+	// the report is replaced, so that removed templates aren't reported.
+	if err := c.Send("MULTI"); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := c.Send("DEL", args[0]); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := c.Send("HSET", args...); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := c.Send("PEXPIRE", args[0], int64(f.TTL/time.Millisecond)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err := c.Do("EXEC")
+	return errors.Wrap(err, "failed to report the state of the node")
+}
+
+// getGeneration returns the value of GenerationKey, which is zero until a change is published.
+func getGeneration(c redis.Conn) (int64, error) {
+	generation, err := redis.Int64(c.Do("GET", GenerationKey))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return generation, errors.Wrap(err, "failed to get the generation")
+}
+
+// heartbeat refreshes the node's report until done is closed.
+func heartbeat(cfg Config, done chan struct{}) {
+	ticker := time.NewTicker(cfg.Fleet.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := cfg.Fleet.report(cfg.Pool, false); err != nil {
+				cfg.Logger.WithError(err).Warn("failed to send heartbeat")
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// FleetStatus returns the state of every node whose report hasn't expired, sorted by name.
+func FleetStatus(p *redis.Pool) (FleetReport, error) {
+	c := p.Get()
+	defer c.Close()
+
+	generation, err := getGeneration(c)
+	if err != nil {
+		return FleetReport{}, err
+	}
+
+	keys, err := scanKeys(c.Do, FleetPrefix)
+	if err != nil {
+		return FleetReport{}, err
+	}
+
+	report := FleetReport{Generation: generation, Nodes: []NodeStatus{}}
+	for _, key := range keys {
+		fields, err := redis.StringMap(c.Do("HGETALL", key))
+		if err != nil {
+			return FleetReport{}, errors.Wrapf(err, "failed to get the state of node %s", key)
+		}
+
+		// the report expired after it was listed.
+		if len(fields) == 0 {
+			continue
+		}
+
+		node, err := parseNodeStatus(strings.TrimPrefix(key, FleetPrefix), fields, generation)
+		if err != nil {
+			return FleetReport{}, err
+		}
+
+		report.Nodes = append(report.Nodes, node)
+	}
+
+	return report, nil
+}
+
+// parseNodeStatus parses the fields of a node's report, deciding its state from the current generation.
+func parseNodeStatus(name string, fields map[string]string, generation int64) (NodeStatus, error) {
+	node := NodeStatus{Node: name, Templates: []NodeTemplate{}}
+
+	var err error
+	if node.Generation, err = strconv.ParseInt(fields[generationField], 10, 64); err != nil {
+		return NodeStatus{}, errors.Errorf("node %s reported an invalid generation", name)
+	}
+
+	// a node that hasn't finished an update yet reports a zero time.
+	node.Updated, _ = time.Parse(time.RFC3339Nano, fields[updatedField])
+	node.Heartbeat, _ = time.Parse(time.RFC3339Nano, fields[heartbeatField])
+
+	for field, value := range fields {
+		if !strings.HasPrefix(field, templateFieldPrefix) {
+			continue
+		}
+
+		var template NodeTemplate
+		if err := json.Unmarshal([]byte(value), &template); err != nil {
+			return NodeStatus{}, errors.Errorf("node %s reported an invalid template %s", name, field)
+		}
+
+		node.Templates = append(node.Templates, template)
+	}
+
+	sort.Slice(node.Templates, func(i, j int) bool {
+		return node.Templates[i].Name < node.Templates[j].Name
+	})
+
+	node.State = NodeUpToDate
+	switch {
+	case node.failing():
+		node.State = NodeFailing
+	case node.Updated.IsZero() || node.Generation < generation:
+		node.State = NodeStale
+	}
+
+	return node, nil
+}
+
+// failing reports whether any of the node's templates are failing.
+func (n NodeStatus) failing() bool {
+	for _, template := range n.Templates {
+		if template.failing() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeStatus(t *testing.T) {
+	fields := map[string]string{
+		generationField:                "4",
+		updatedField:                   "2026-10-18T10:00:00Z",
+		heartbeatField:                 "2026-10-18T10:00:05Z",
+		templateFieldPrefix + "b.tmpl": `{"name":"b.tmpl","target":"b.conf","output_hash":"abc","exit_code":0}`,
+		templateFieldPrefix + "a.tmpl": `{"name":"a.tmpl"}`,
+	}
+
+	node, err := parseNodeStatus("web1", fields, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exitCode := 0
+	assert.Equal(t, NodeStatus{
+		Node:       "web1",
+		State:      NodeUpToDate,
+		Generation: 4,
+		Updated:    time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC),
+		Heartbeat:  time.Date(2026, 10, 18, 10, 0, 5, 0, time.UTC),
+		Templates: []NodeTemplate{
+			{Name: "a.tmpl"},
+			{Name: "b.tmpl", Target: "b.conf", OutputHash: "abc", ExitCode: &exitCode},
+		},
+	}, node)
+
+	node, err = parseNodeStatus("web1", fields, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, NodeStale, node.State)
+
+	fields[templateFieldPrefix+"a.tmpl"] = `{"name":"a.tmpl","exit_code":1,"error":"exit status 1"}`
+	node, err = parseNodeStatus("web1", fields, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, NodeFailing, node.State)
+
+	// a node that hasn't finished its first update is stale.
+	node, err = parseNodeStatus("web2", map[string]string{generationField: "0", updatedField: time.Time{}.Format(time.RFC3339Nano)}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, NodeStale, node.State)
+
+	_, err = parseNodeStatus("web3", map[string]string{generationField: "x"}, 0)
+	assert.Error(t, err)
+}
+
+func TestFleet_Records(t *testing.T) {
+	target := "app.conf"
+	tmpl := Template{SourceTemplate: template.New("app.tmpl"), Target: &target}
+
+	fleet := NewFleet("web1", time.Minute)
+	fleet.setTemplates([]Template{tmpl})
+	fleet.templateRendered("app.tmpl", []byte("output"))
+	fleet.commandCompleted("app.tmpl", nil)
+	fleet.renderFailed("other.tmpl", errors.New("ignored"))
+
+	record := fleet.templates["app.tmpl"]
+	assert.Equal(t, "app.conf", record.Target)
+	assert.Equal(t, "e0ee8bb50685e05f", record.OutputHash[:16])
+	assert.False(t, record.failing())
+
+	fleet.renderFailed("app.tmpl", errors.New("template: app.tmpl:1: boom"))
+	assert.True(t, record.failing())
+	assert.Len(t, fleet.templates, 1)
+	assert.Equal(t, 20*time.Second, fleet.heartbeatInterval())
+
+	// a nil fleet reports nothing.
+	var nilFleet *Fleet
+	nilFleet.setTemplates([]Template{tmpl})
+	nilFleet.templateRendered("app.tmpl", nil)
+	assert.NoError(t, nilFleet.report(nil, true))
+	assert.NoError(t, nilFleet.beginUpdate(nil))
+}
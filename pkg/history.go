@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// HistoryPrefix is prepended to a key to name the stream its history is recorded in.
+const HistoryPrefix = "redis-template:history:"
+
+// maxChangeAttempts is the number of times a change is retried when the key is modified while it is being changed.
+const maxChangeAttempts = 10
+
+// ErrConcurrentChange is returned when a key couldn't be changed within maxChangeAttempts attempts, because it kept
+// being modified by someone else.
+var ErrConcurrentChange = errors.New("key kept changing while it was being changed")
+
+// HistoryOptions control how changes are recorded in the history of a key.
+type HistoryOptions struct {
+	// Author is who made the change.
+	Author string
+
+	// MaxLen, if positive, is the number of changes kept in the history of each key. Older changes are trimmed.
+	MaxLen int
+}
+
+// HistoryEntry is a change to a key, recorded in its history.
+type HistoryEntry struct {
+	// Version is the id of the change in the history stream.
+	Version string
+	Time    time.Time
+	Author  string
+
+	// Old and New are the values of the key before and after the change. They are nil if the key didn't exist.
+	Old *string
+	New *string
+}
+
+// historyKey returns the name of the stream the history of the key is recorded in.
+func historyKey(key string) string {
+	return HistoryPrefix + key
+}
+
+// SetKey sets the key and publishes a notification on the channel, recording the change in the key's history.
+func SetKey(p *redis.Pool, channel string, key string, value string, opts HistoryOptions) error {
+	return ApplyChanges(p, channel, []Change{{Key: key, Value: StringValue(value)}}, opts)
+}
+
+// historyArgs returns the arguments to XADD recording the change to the value of a key, whose old value is given.
+func historyArgs(change Change, old interface{}, opts HistoryOptions) redis.Args {
+	args := redis.Args{historyKey(change.Key)}
+	if opts.MaxLen > 0 {
+		args = args.Add("MAXLEN", opts.MaxLen)
+	}
+
+	args = args.Add("*", "author", opts.Author)
+	if old != nil {
+		args = args.Add("old", old)
+	}
+
+	if change.Value != nil && change.Value.Type == TypeString {
+		args = args.Add("new", change.Value.String)
+	}
+
+	return args
+}
+
+// History returns the last count changes to the key, newest first. A count of zero returns every change.
+func History(p *redis.Pool, key string, count int) ([]HistoryEntry, error) {
+	c := p.Get()
+	defer c.Close()
+
+	args := redis.Args{historyKey(key), "+", "-"}
+	if count > 0 {
+		args = args.Add("COUNT", count)
+	}
+
+	return historyEntries(c.Do("XREVRANGE", args...))
+}
+
+// historyEntry returns the change to the key with the given version.
+func historyEntry(c redis.Conn, key string, version string) (HistoryEntry, error) {
+	entries, err := historyEntries(c.Do("XRANGE", historyKey(key), version, version))
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+
+	if len(entries) == 0 {
+		return HistoryEntry{}, errors.Errorf("key %s has no version %s", key, version)
+	}
+
+	return entries[0], nil
+}
+
+// historyEntries parses the reply to XRANGE or XREVRANGE on a history stream.
+func historyEntries(reply interface{}, err error) ([]HistoryEntry, error) {
+	messages, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read history")
+	}
+
+	entries := make([]HistoryEntry, len(messages))
+	for i, message := range messages {
+		parts, err := redis.Values(message, nil)
+		if err != nil || len(parts) != 2 {
+			return nil, errors.New("unexpected history entry")
+		}
+
+		version, err := redis.String(parts[0], nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "unexpected history entry")
+		}
+
+		fields, err := redis.StringMap(parts[1], nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "unexpected history entry")
+		}
+
+		entries[i] = HistoryEntry{
+			Version: version,
+			Time:    versionTime(version),
+			Author:  fields["author"],
+		}
+
+		if old, ok := fields["old"]; ok {
+			entries[i].Old = &old
+		}
+
+		if value, ok := fields["new"]; ok {
+			entries[i].New = &value
+		}
+	}
+
+	return entries, nil
+}
+
+// versionTime returns the time a version was recorded, from the milliseconds at the start of its stream id.
+func versionTime(version string) time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(version, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Rollback restores a previous value of the key, publishing a notification on the channel. If version is empty the
+// last change is undone, otherwise the key is restored to the value it was given by that version. The rollback is
+// itself recorded in the key's history. The restored value is returned, nil if the key was deleted.
+func Rollback(p *redis.Pool, channel string, key string, version string, opts HistoryOptions) (*string, error) {
+	value, err := rollbackValue(p, key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	change := Change{Key: key}
+	if value != nil {
+		change.Value = StringValue(*value)
+	}
+
+	return value, ApplyChanges(p, channel, []Change{change}, opts)
+}
+
+// rollbackValue returns the value the key is restored to by rolling back to the version.
+func rollbackValue(p *redis.Pool, key string, version string) (*string, error) {
+	c := p.Get()
+	defer c.Close()
+
+	if version != "" {
+		entry, err := historyEntry(c, key, version)
+		return entry.New, err
+	}
+
+	entries, err := historyEntries(c.Do("XREVRANGE", historyKey(key), "+", "-", "COUNT", 1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.Errorf("key %s has no history", key)
+	}
+
+	return entries[0].Old, nil
+}
@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionTime(t *testing.T) {
+	assert.Equal(t, time.Unix(1700000000, 123*int64(time.Millisecond)), versionTime("1700000000123-0"))
+	assert.True(t, versionTime("invalid").IsZero())
+}
+
+func TestHistoryEntries(t *testing.T) {
+	entries, err := historyEntries([]interface{}{
+		[]interface{}{
+			[]byte("1700000000000-0"),
+			[]interface{}{[]byte("author"), []byte("tester"), []byte("new"), []byte("a")},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := "a"
+	assert.Equal(t, []HistoryEntry{{
+		Version: "1700000000000-0",
+		Time:    time.Unix(1700000000, 0),
+		Author:  "tester",
+		New:     &value,
+	}}, entries)
+}
@@ -0,0 +1,352 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// The formats that keys can be imported from.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatEnv  = "env"
+)
+
+// KeySeparator separates the parts of the keys that nested values are flattened to, e.g. a:b:c.
+const KeySeparator = ":"
+
+// FormatFromPath returns the format of a file from its extension, defaulting to json.
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".env":
+		return FormatEnv
+	}
+
+	if strings.HasPrefix(filepath.Base(path), ".env") {
+		return FormatEnv
+	}
+
+	return FormatJSON
+}
+
+// ParseValues parses a document in the given format into nested values, decoded as encoding/json decodes them with
+// UseNumber.
+func ParseValues(data []byte, format string) (map[string]interface{}, error) {
+	var value interface{}
+	switch format {
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, errors.Wrap(err, "invalid json")
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return nil, errors.Wrap(err, "invalid yaml")
+		}
+
+		value = jsonValue(value)
+	case FormatEnv:
+		return parseDotenv(data)
+	default:
+		return nil, errors.Errorf("unknown format %s", format)
+	}
+
+	if value == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	values, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the document must be an object")
+	}
+
+	return values, nil
+}
+
+// jsonValue converts a value decoded by yaml into the value encoding/json decodes with UseNumber. Mappings become
+// objects, with keys that aren't strings given as their text, and numbers become json.Number. Numbers json can't
+// represent, such as .inf, are kept as their text.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, nested := range v {
+			object[fmt.Sprint(key)] = jsonValue(nested)
+		}
+
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, nested := range v {
+			array[i] = jsonValue(nested)
+		}
+
+		return array
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Sprint(v)
+		}
+
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	default:
+		return v
+	}
+}
+
+// parseDotenv parses a dotenv file of KEY=value lines. Lines may start with "export", values may be single quoted,
+// taken literally except for two single quotes, which are a single quote, or double quoted, with escapes. Quoted
+// values may only be followed by a comment, and unquoted values end at a " #" comment.
+func parseDotenv(data []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.IndexRune(line, '=')
+		if i < 1 {
+			return nil, errors.Errorf("env line %d: expected KEY=value", number)
+		}
+
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := closingQuote(value)
+			if end == -1 {
+				return nil, errors.Errorf("env line %d: unterminated quoted value", number)
+			}
+
+			var unquoted string
+			if err := json.Unmarshal([]byte(value[:end+1]), &unquoted); err != nil {
+				return nil, errors.Errorf("env line %d: invalid quoted value", number)
+			}
+
+			if !onlyComment(value[end+1:]) {
+				return nil, errors.Errorf("env line %d: unexpected text after the quoted value", number)
+			}
+
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			end := closingSingleQuote(value)
+			if end == -1 {
+				return nil, errors.Errorf("env line %d: unterminated quoted value", number)
+			}
+
+			if !onlyComment(value[end+1:]) {
+				return nil, errors.Errorf("env line %d: unexpected text after the quoted value", number)
+			}
+
+			value = strings.Replace(value[1:end], "''", "'", -1)
+		default:
+			if comment := strings.Index(value, " #"); comment != -1 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+
+		values[key] = value
+	}
+
+	return values, errors.WithStack(scanner.Err())
+}
+
+// closingQuote returns the index of the double quote closing the string starting with a double quote, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// closingSingleQuote returns the index of the single quote closing the string starting with a single quote, or -1.
+// Two single quotes are an escaped single quote.
+func closingSingleQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			continue
+		}
+
+		if i+1 < len(s) && s[i+1] == '\'' {
+			i++
+			continue
+		}
+
+		return i
+	}
+
+	return -1
+}
+
+// onlyComment reports whether the text following a quoted value is empty or a comment.
+func onlyComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// FlattenValues flattens nested values into keys, joining the names of nested objects with KeySeparator and prefixing
+// every key with the prefix. Numbers and booleans are stored as their json text, arrays as json, and nulls as empty
+// strings. Objects giving a $type and $value, as written by export, are stored as that type.
+func FlattenValues(prefix string, values map[string]interface{}) (map[string]Value, error) {
+	flattened := map[string]Value{}
+	return flattened, flattenValue(flattened, prefix, values)
+}
+
+// flattenValue adds the value to the flattened keys under the key.
+func flattenValue(flattened map[string]Value, key string, value interface{}) error {
+	if valueType, typed, ok := typedDocument(value); ok && key != "" {
+		parsed, err := parseTypedDocument(valueType, typed)
+		if err != nil {
+			return errors.Wrapf(err, "invalid value for %s", key)
+		}
+
+		flattened[key] = parsed
+		return nil
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		for name, nested := range object {
+			nestedKey := key + name
+			if key != "" && !strings.HasSuffix(key, KeySeparator) {
+				nestedKey = key + KeySeparator + name
+			}
+
+			if err := flattenValue(flattened, nestedKey, nested); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if key == "" {
+		return errors.New("values must be given in an object")
+	}
+
+	flattened[key] = *StringValue(scalarText(value))
+	return nil
+}
+
+// PlanImport returns the changes that make the keys in redis match the values. Keys that already have their value are
+// left alone. If prune is set, keys under the prefix that aren't in the values are deleted.
+func PlanImport(p *redis.Pool, prefix string, values map[string]Value, prune bool) ([]Change, error) {
+	c := p.Get()
+	defer c.Close()
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var changes []Change
+	for _, key := range keys {
+		current, err := readValue(c, key)
+		if err != nil {
+			return nil, err
+		}
+
+		value := values[key]
+		if current != nil && current.equal(value) {
+			continue
+		}
+
+		changes = append(changes, Change{Key: key, Value: &value})
+	}
+
+	if !prune {
+		return changes, nil
+	}
+
+	if prefix == "" {
+		return nil, errors.New("a prefix is required to prune keys")
+	}
+
+	// the prefix is scanned as a namespace, so that pruning app doesn't delete apple.
+	if !strings.HasSuffix(prefix, KeySeparator) {
+		prefix += KeySeparator
+	}
+
+	existing, err := scanKeys(c.Do, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range existing {
+		if _, ok := values[key]; !ok && !strings.HasPrefix(key, HistoryPrefix) {
+			changes = append(changes, Change{Key: key})
+		}
+	}
+
+	return changes, nil
+}
+
+// scanKeys returns the keys starting with the prefix, in sorted order, running SCAN with the given function.
+func scanKeys(do func(string, ...interface{}) (interface{}, error), prefix string) ([]string, error) {
+	seen := map[string]bool{}
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := redis.Values(do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", scanCount))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list keys %s", prefix)
+		}
+
+		if len(reply) != 2 {
+			return nil, errors.Errorf("unexpected reply to SCAN listing keys %s", prefix)
+		}
+
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list keys %s", prefix)
+		}
+
+		batch, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list keys %s", prefix)
+		}
+
+		// SCAN can return a key more than once.
+		for _, key := range batch {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
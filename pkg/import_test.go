@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatFromPath(t *testing.T) {
+	assert.Equal(t, FormatYAML, FormatFromPath("values.yml"))
+	assert.Equal(t, FormatYAML, FormatFromPath("values.YAML"))
+	assert.Equal(t, FormatEnv, FormatFromPath("prod.env"))
+	assert.Equal(t, FormatEnv, FormatFromPath("/app/.env.local"))
+	assert.Equal(t, FormatJSON, FormatFromPath("values.json"))
+}
+
+func TestParseValues_YAML(t *testing.T) {
+	values, err := ParseValues([]byte(`
+# database settings
+db:
+  host: "10.0.0.2" # the primary
+  port: 5432
+  replicas:
+  - 10.0.0.3
+  - 10.0.0.4
+  enabled: true
+  password: 'it''s a secret'
+cert: |
+  line one
+  line two
+empty: {}
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"db": map[string]interface{}{
+			"host":     "10.0.0.2",
+			"port":     json.Number("5432"),
+			"replicas": []interface{}{"10.0.0.3", "10.0.0.4"},
+			"enabled":  true,
+			"password": "it's a secret",
+		},
+		"cert":  "line one\nline two\n",
+		"empty": map[string]interface{}{},
+	}, values)
+}
+
+// TestParseValues_YAMLFlow tests that flow collections, anchors and numbers json can't represent are parsed.
+func TestParseValues_YAMLFlow(t *testing.T) {
+	values, err := ParseValues([]byte(`
+defaults: &defaults {timeout: 1.5, retries: 3}
+db:
+  <<: *defaults
+  replicas: [10.0.0.3, "10.0.0.4"]
+  limit: .inf
+ports: {80: http, 443: https}
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"defaults": map[string]interface{}{"timeout": json.Number("1.5"), "retries": json.Number("3")},
+		"db": map[string]interface{}{
+			"timeout":  json.Number("1.5"),
+			"retries":  json.Number("3"),
+			"replicas": []interface{}{"10.0.0.3", "10.0.0.4"},
+			"limit":    "+Inf",
+		},
+		"ports": map[string]interface{}{"80": "http", "443": "https"},
+	}, values)
+
+	_, err = ParseValues([]byte("- a\n- b\n"), FormatYAML)
+	assert.EqualError(t, err, "the document must be an object")
+
+	_, err = ParseValues([]byte("a: [b"), FormatYAML)
+	assert.Error(t, err)
+}
+
+func TestParseValues_Env(t *testing.T) {
+	values, err := ParseValues([]byte(`
+# comment
+export DB_HOST=10.0.0.2 # the primary
+DB_PASSWORD='p#ss'
+GREETING="hello\nworld"
+QUOTE='it''s' # a comment
+`), FormatEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"DB_HOST":     "10.0.0.2",
+		"DB_PASSWORD": "p#ss",
+		"GREETING":    "hello\nworld",
+		"QUOTE":       "it's",
+	}, values)
+
+	_, err = ParseValues([]byte(`QUOTE='it's'`), FormatEnv)
+	assert.EqualError(t, err, "env line 1: unexpected text after the quoted value")
+
+	_, err = ParseValues([]byte(`QUOTE='it''s`), FormatEnv)
+	assert.EqualError(t, err, "env line 1: unterminated quoted value")
+}
+
+func TestFlattenValues(t *testing.T) {
+	values, err := ParseValues([]byte(`{
+		"db": {"host": "10.0.0.2", "port": 5432, "tags": ["a"]},
+		"debug": null,
+		"replicas": {"$type": "set", "$value": ["b", "a"]}
+	}`), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flattened, err := FlattenValues("app", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]Value{
+		"app:db:host":  *StringValue("10.0.0.2"),
+		"app:db:port":  *StringValue("5432"),
+		"app:db:tags":  *StringValue(`["a"]`),
+		"app:debug":    *StringValue(""),
+		"app:replicas": {Type: TypeSet, Members: []string{"b", "a"}},
+	}, flattened)
+}
+
+func TestChange_String(t *testing.T) {
+	assert.Equal(t, `set db:host "10.0.0.2"`, Change{Key: "db:host", Value: StringValue("10.0.0.2")}.String())
+	assert.Equal(t, `set vhosts hash(1)`,
+		Change{Key: "vhosts", Value: &Value{Type: TypeHash, Fields: map[string]string{"a": "b"}}}.String())
+	assert.Equal(t, `hset vhost root "/srv" tls "on"`,
+		Change{Key: "vhost", Fields: map[string]string{"tls": "on", "root": "/srv"}}.String())
+	assert.Equal(t, "del db:host", Change{Key: "db:host"}.String())
+}
+
+func TestNotification(t *testing.T) {
+	assert.Equal(t, `{"keys":["a","b"]}`, notification([]string{"a", "b"}, nil))
+	assert.Equal(t, `{"keys":[]}`, notification(nil, nil))
+	assert.Equal(t, `{"keys":[],"selector":"role=web,region=eu"}`,
+		notification(nil, Selector{{Label: "role", Values: []string{"web"}}, {Label: "region", Values: []string{"eu"}}}))
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// LeaderPrefix is the prefix of the keys used to elect a leader. It is followed by the name of the election.
+const LeaderPrefix = "redis-template:leader:"
+
+// The nodes a template's command runs on, given by its run_on.
+const (
+	// RunOnAll runs the command on every node. It is the default.
+	RunOnAll = "all"
+
+	// RunOnLeader only runs the command on the leader. Every node still writes the template's outputs.
+	RunOnLeader = "leader"
+)
+
+// MinLeaderTTL is the shortest ttl of the leadership. The leadership is renewed every third of it, which must leave time
+// for the renewals to reach redis.
+const MinLeaderTTL = time.Second
+
+// FencingTokenEnv is the environment variable the fencing token of the leader is given to commands in. Tokens increase
+// with every new leader, so that the systems a command changes can reject changes from a leader that has been replaced.
+const FencingTokenEnv = "REDIS_TEMPLATE_FENCING_TOKEN"
+
+// ErrLeadershipLost is reported when a node stops being the leader while running a command that only runs on the
+// leader.
+var ErrLeadershipLost = errors.New("lost leadership while running the command")
+
+// campaignScript takes the leadership for ARGV[1] with SET NX PX, giving it a new fencing token, or extends it if
+// ARGV[1] already leads. It returns the leader's fencing token, or 0 if another node leads. The lease is stored as
+// "<token>:<id>".
+var campaignScript = redis.NewScript(2, `
+local current = redis.call('GET', KEYS[1])
+if current then
+	local separator = string.find(current, ':', 1, true)
+	if separator and string.sub(current, separator + 1) == ARGV[1] then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+		return tonumber(string.sub(current, 1, separator - 1))
+	end
+
+	return 0
+end
+
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], token .. ':' .. ARGV[1], 'NX', 'PX', ARGV[2])
+return token
+`)
+
+// resignScript deletes the lease if it is held by ARGV[1].
+var resignScript = redis.NewScript(1, `
+local current = redis.call('GET', KEYS[1])
+if current then
+	local separator = string.find(current, ':', 1, true)
+	if separator and string.sub(current, separator + 1) == ARGV[1] then
+		return redis.call('DEL', KEYS[1])
+	end
+end
+
+return 0
+`)
+
+// Election elects one node as the leader, which runs the commands of the templates that run on the leader. The leader
+// holds a lease in redis that it renews, and that expires if it dies. A nil *Election never leads.
+type Election struct {
+	Pool *redis.Pool
+
+	// Name is the name of the election. Nodes with the same name elect one leader between them.
+	Name string
+
+	// ID identifies the node, it must be unique among the nodes in the election.
+	ID string
+
+	// TTL is how long the lease lasts without being renewed. It is renewed every third of it.
+	TTL time.Duration
+
+	mut     sync.Mutex
+	token   int64
+	expires time.Time
+}
+
+// NewElection creates an Election.
+func NewElection(p *redis.Pool, name string, id string, ttl time.Duration) *Election {
+	return &Election{Pool: p, Name: name, ID: id, TTL: ttl}
+}
+
+// key returns the key holding the lease.
+func (e *Election) key() string {
+	return LeaderPrefix + e.Name
+}
+
+// Leader returns the fencing token of the node's leadership, and whether it is the leader. The node stops considering
+// itself the leader when its lease would have expired, even if it hasn't been able to reach redis to learn that.
+func (e *Election) Leader() (int64, bool) {
+	if e == nil {
+		return 0, false
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	if e.token == 0 || !time.Now().Before(e.expires) {
+		return 0, false
+	}
+
+	return e.token, true
+}
+
+// campaign takes or extends the leadership, if no other node leads, returning the fencing token if the node leads.
+func (e *Election) campaign() (int64, error) {
+	// the lease is measured from before it was asked for, so that the node never thinks it leads for longer than redis.
+	start := time.Now()
+
+	c := e.Pool.Get()
+	defer c.Close()
+
+	token, err := redis.Int64(campaignScript.Do(c, e.key(), e.key()+":token", e.ID, int64(e.TTL/time.Millisecond)))
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	// an error leaves the lease as it was, it expires on its own if redis can't be reached.
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to campaign in election %s", e.Name)
+	}
+
+	e.token = token
+	e.expires = start.Add(e.TTL)
+	return token, nil
+}
+
+// run campaigns every third of the ttl until done is closed, logging when the node gains and loses the leadership.
+func (e *Election) run(logger *log.Logger, done chan struct{}) {
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.campaignLogged(logger)
+		case <-done:
+			return
+		}
+	}
+}
+
+// campaignLogged campaigns, logging when the node gains and loses the leadership.
+func (e *Election) campaignLogged(logger *log.Logger) {
+	previous, led := e.Leader()
+	token, err := e.campaign()
+	if err != nil {
+		logger.WithError(err).Warn("failed to renew the leadership")
+	}
+
+	current, leads := e.Leader()
+	fields := log.Fields{"election": e.Name, "fencing_token": current}
+	switch {
+	case leads && (!led || previous != current):
+		logger.WithFields(fields).Info("became the leader")
+	case led && !leads:
+		logger.WithFields(fields).WithField("fencing_token", previous).Warn("lost the leadership")
+	case err == nil && token == 0:
+		logger.WithField("election", e.Name).Debug("another node leads")
+	}
+}
+
+// resign gives up the leadership, if the node leads, so that another node can take it without waiting for the lease
+// to expire.
+func (e *Election) resign() error {
+	e.mut.Lock()
+	e.token = 0
+	e.mut.Unlock()
+
+	c := e.Pool.Get()
+	defer c.Close()
+
+	_, err := resignScript.Do(c, e.key(), e.ID)
+	return errors.Wrapf(err, "failed to resign from election %s", e.Name)
+}
+
+// LeaderStatus is the state of an election.
+type LeaderStatus struct {
+	Name string `json:"name"`
+
+	// ID identifies the leader. It is empty if no node leads.
+	ID           string `json:"id,omitempty"`
+	FencingToken int64  `json:"fencing_token,omitempty"`
+}
+
+// GetLeader returns the current leader of the named election.
+func GetLeader(p *redis.Pool, name string) (LeaderStatus, error) {
+	c := p.Get()
+	defer c.Close()
+
+	status := LeaderStatus{Name: name}
+	lease, err := redis.String(c.Do("GET", LeaderPrefix+name))
+	if err == redis.ErrNil {
+		return status, nil
+	}
+
+	if err != nil {
+		return LeaderStatus{}, errors.Wrapf(err, "failed to get the leader of election %s", name)
+	}
+
+	token, id, err := parseLease(lease)
+	if err != nil {
+		return LeaderStatus{}, errors.Wrapf(err, "invalid lease in election %s", name)
+	}
+
+	status.ID, status.FencingToken = id, token
+	return status, nil
+}
+
+// parseLease parses a lease stored by campaignScript into its fencing token and the id of the leader.
+func parseLease(lease string) (int64, string, error) {
+	i := strings.Index(lease, ":")
+	if i == -1 {
+		return 0, "", errors.Errorf("no fencing token in %q", lease)
+	}
+
+	token, err := strconv.ParseInt(lease[:i], 10, 64)
+	if err != nil {
+		return 0, "", errors.WithStack(err)
+	}
+
+	return token, lease[i+1:], nil
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLease(t *testing.T) {
+	token, id, err := parseLease("42:web1:1234")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), token)
+	assert.Equal(t, "web1:1234", id)
+
+	_, _, err = parseLease("web1")
+	assert.Error(t, err)
+
+	_, _, err = parseLease("x:web1")
+	assert.Error(t, err)
+}
+
+func TestElection_Nil(t *testing.T) {
+	var e *Election
+	token, leads := e.Leader()
+	assert.False(t, leads)
+	assert.Equal(t, int64(0), token)
+}
+
+func TestToTemplate_RunOn(t *testing.T) {
+	const TestTemplate = "./test_files/run_on.tmpl"
+
+	if err := ioutil.WriteFile(TestTemplate, []byte(`{{ key "a" }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, runOn := range []string{"", RunOnAll, RunOnLeader} {
+		_, err := TemplateFlag{Source: TestTemplate, RunOn: runOn}.ToTemplate(nil)
+		assert.NoError(t, err, runOn)
+	}
+
+	_, err := TemplateFlag{Source: TestTemplate, RunOn: "leaders"}.ToTemplate(nil)
+	assert.EqualError(t, err, "invalid run_on leaders, expected all or leader")
+}
+
+func TestTemplate_ExecuteWith(t *testing.T) {
+	const TestTemplate = "./test_files/run_on.tmpl"
+
+	if err := ioutil.WriteFile(TestTemplate, []byte(`{{ key "a" }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the command built from the flag sees the environment variables.
+	command := fmt.Sprintf(`test "$%s" = 7`, FencingTokenEnv)
+	template, err := TemplateFlag{Source: TestTemplate, Action: command, RunOn: RunOnLeader}.ToTemplate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, template.executeWith([]string{FencingTokenEnv + "=7"}))
+	assert.Error(t, template.executeWith(nil))
+
+	// an Action that replaced the command is still called.
+	called := 0
+	template.Action = func() error {
+		called++
+		return nil
+	}
+
+	assert.NoError(t, template.executeWith([]string{FencingTokenEnv + "=7"}))
+	assert.Equal(t, 1, called)
+}
+
+// TestListen_RunOnLeaderAction tests that the leader calls the Action of a template that runs on the leader.
+func TestListen_RunOnLeaderAction(t *testing.T) {
+	const TestTemplate = "./test_files/run_on.tmpl"
+	const TestOutput = "./test_files/run_on.out"
+
+	env := SetupTestEnvironment(6363, t)
+	defer env.Cleanup()
+
+	if err := ioutil.WriteFile(TestTemplate, []byte(`{{ key "a" }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	mut := &sync.Mutex{}
+	actionCount := 0
+	go Listen(Config{
+		Logger:  env.Logger,
+		Channel: RedisTemplateChannel,
+		Templates: []Template{
+			MustTemplate(t, env.Pool, TemplateFlag{Source: TestTemplate, Target: TestOutput, RunOn: RunOnLeader}, func() error {
+				mut.Lock()
+				actionCount++
+				mut.Unlock()
+				return nil
+			}),
+		},
+		Pool:     env.Pool,
+		Election: NewElection(env.Pool, "default", "web1", time.Second),
+	})
+
+	for i := 0; i < 50; i++ {
+		mut.Lock()
+		count := actionCount
+		mut.Unlock()
+
+		if count == 1 {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatal("the action of the template wasn't called by the leader")
+}
+
+func TestTemplate_CommandPending(t *testing.T) {
+	leader := &Election{token: 1, expires: time.Now().Add(time.Minute)}
+	template := Template{state: &templateState{}}
+
+	assert.False(t, template.commandPending(leader))
+
+	// a skipped command is pending once the node leads.
+	template.state.setCommandSkipped(true)
+	assert.False(t, template.commandPending(nil))
+	assert.True(t, template.commandPending(leader))
+
+	template.state.setCommandSkipped(false)
+	assert.False(t, template.commandPending(leader))
+}
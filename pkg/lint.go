@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The severities of lint issues. Errors are problems that stop a template from rendering, warnings are problems that
+// render something unexpected.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// LintIssue is a problem found in a template by LintTemplate.
+type LintIssue struct {
+	Severity string `json:"severity"`
+
+	// Location is the file, line and column of the problem, e.g. nginx.conf.tmpl:3:14, if it is known.
+	Location string `json:"location,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// String describes the issue, e.g. error nginx.conf.tmpl:3:14: unknown function kye.
+func (i LintIssue) String() string {
+	if i.Location == "" {
+		return fmt.Sprintf("%s: %s", i.Severity, i.Message)
+	}
+
+	return fmt.Sprintf("%s %s: %s", i.Severity, i.Location, i.Message)
+}
+
+// LintReport is the result of linting a template.
+type LintReport struct {
+	Source string `json:"source"`
+	Target string `json:"target,omitempty"`
+
+	TemplateReferences
+
+	// Missing are the referenced keys that don't exist in redis. It is empty if redis wasn't checked.
+	Missing []string `json:"missing,omitempty"`
+
+	Issues []LintIssue `json:"issues"`
+}
+
+// Errors returns the number of issues that are errors.
+func (r LintReport) Errors() int {
+	errors := 0
+	for _, issue := range r.Issues {
+		if issue.Severity == SeverityError {
+			errors++
+		}
+	}
+
+	return errors
+}
+
+// add records an issue.
+func (r *LintReport) add(severity string, location string, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, LintIssue{Severity: severity, Location: location, Message: fmt.Sprintf(format, args...)})
+}
+
+// LintTemplate checks the template, and its library, without rendering it. It reports syntax errors, unknown
+// functions, templates that are used but never defined, and, if a redis pool is given, the keys the template reads
+// that don't exist under any of the key prefixes.
+func LintTemplate(t TemplateFlag, p *redis.Pool, prefixes []string) LintReport {
+	report := LintReport{Source: t.Source, Target: t.Target, Issues: []LintIssue{}}
+
+	files := []string{t.Source}
+	libraryFiles, err := t.libraryFiles()
+	if err != nil {
+		report.add(SeverityError, "", "%v", err)
+	}
+
+	for _, file := range libraryFiles {
+		if filepath.Clean(file) != filepath.Clean(t.Source) {
+			files = append(files, file)
+		}
+	}
+
+	// the files are parsed without checking their functions, so that every unknown function is reported rather than
+	// only the first.
+	trees := map[string]*parse.Tree{}
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			report.add(SeverityError, "", "%v", err)
+			continue
+		}
+
+		tree := parse.New(file)
+		tree.Mode = parse.SkipFuncCheck
+		if _, err := tree.Parse(string(contents), t.LeftDelimiter, t.RightDelimiter, trees); err != nil {
+			report.add(SeverityError, "", "%v", err)
+		}
+	}
+
+	names := make([]string, 0, len(trees))
+	for name := range trees {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var parsed []*parse.Tree
+	for _, name := range names {
+		parsed = append(parsed, trees[name])
+	}
+
+	funcs := (&render{}).funcMap()
+	for _, tree := range parsed {
+		walkNodes(tree.Root, func(node parse.Node) {
+			switch n := node.(type) {
+			case *parse.IdentifierNode:
+				if !definedFunction(funcs, n.Ident) {
+					location, _ := tree.ErrorContext(n)
+					report.add(SeverityError, location, "unknown function %s", n.Ident)
+				}
+			case *parse.TemplateNode:
+				if _, ok := trees[n.Name]; !ok {
+					location, _ := tree.ErrorContext(n)
+					report.add(SeverityError, location, "template %s is not defined", n.Name)
+				}
+			}
+		})
+	}
+
+	report.TemplateReferences = treeReferences(parsed)
+
+	// the template is built as it would be when listening, which also checks its target.
+	if report.Errors() == 0 {
+		if _, err := t.ToTemplate(p); err != nil {
+			report.add(SeverityError, "", "%v", err)
+		}
+	}
+
+	if p != nil && len(report.Keys) > 0 {
+		lintMissingKeys(&report, t, p, prefixes)
+	}
+
+	return report
+}
+
+// definedFunction reports whether the function is one of the template functions, or one of the functions built into
+// text/template.
+func definedFunction(funcs template.FuncMap, name string) bool {
+	if _, ok := funcs[name]; ok {
+		return true
+	}
+
+	_, err := template.New(name).Parse(fmt.Sprintf("{{ %s }}", name))
+	return err == nil
+}
+
+// lintMissingKeys records the referenced keys that don't exist in redis under any of the prefixes. A missing key stops
+// a strict template from rendering, and renders empty otherwise. Keys read by keyOrDefault render their default.
+func lintMissingKeys(report *LintReport, t TemplateFlag, p *redis.Pool, prefixes []string) {
+	c := p.Get()
+	defer c.Close()
+
+	for _, key := range report.Keys {
+		args := redis.Args{}.AddFlat(layerKeys(prefixes, key))
+		if err := c.Send("EXISTS", args...); err != nil {
+			report.add(SeverityError, "", "failed to check keys: %v", err)
+			return
+		}
+	}
+
+	if err := c.Flush(); err != nil {
+		report.add(SeverityError, "", "failed to check keys: %v", err)
+		return
+	}
+
+	defaulted := map[string]bool{}
+	for _, key := range report.Defaulted {
+		defaulted[key] = true
+	}
+
+	for _, key := range report.Keys {
+		// EXISTS counts the layers the key exists under, which is true if there are any.
+		exists, err := redis.Bool(c.Receive())
+		if err != nil {
+			report.add(SeverityError, "", "failed to check key %s: %v", key, err)
+			return
+		}
+
+		if exists {
+			continue
+		}
+
+		report.Missing = append(report.Missing, key)
+		switch {
+		case defaulted[key]:
+		case t.IsStrict():
+			report.add(SeverityError, "", "key %s doesn't exist", key)
+		default:
+			report.add(SeverityWarning, "", "key %s doesn't exist, and renders empty", key)
+		}
+	}
+}
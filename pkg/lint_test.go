@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "app.tmpl")
+	err = ioutil.WriteFile(source, []byte(`{{ key "db:host" }}:{{ keyOrDefault "db:port" "5432" }}
+{{ kye "db:user" }}{{ template "footer" }}{{ template "header" }}
+{{ range ls "vhosts:" }}{{ upper . }}{{ end }}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "footer.lib"), []byte(`{{ define "footer" }}{{ len "x" }}{{ end }}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := LintTemplate(TemplateFlag{Source: source, Target: "app.conf", Library: filepath.Join(dir, "*.lib")}, nil, nil)
+	assert.Equal(t, []string{"db:host", "db:port"}, report.Keys)
+	assert.Equal(t, []string{"db:port"}, report.Defaulted)
+	assert.Equal(t, []string{"vhosts:"}, report.Prefixes)
+	assert.Equal(t, []LintIssue{
+		{Severity: SeverityError, Location: source + ":2:3", Message: "unknown function kye"},
+		{Severity: SeverityError, Location: source + ":2:54", Message: "template header is not defined"},
+		{Severity: SeverityError, Location: source + ":3:27", Message: "unknown function upper"},
+	}, report.Issues)
+	assert.Equal(t, 3, report.Errors())
+}
+
+func TestLintTemplate_SyntaxError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "app.tmpl")
+	if err := ioutil.WriteFile(source, []byte(`{{ if key "a" }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report := LintTemplate(TemplateFlag{Source: source}, nil, nil)
+	assert.Equal(t, 1, report.Errors())
+	assert.Contains(t, report.Issues[0].Message, "unexpected EOF")
+
+	report = LintTemplate(TemplateFlag{Source: filepath.Join(dir, "missing.tmpl")}, nil, nil)
+	assert.Equal(t, 1, report.Errors())
+}
+
+func TestLintIssue_String(t *testing.T) {
+	assert.Equal(t, "error app.tmpl:2:3: unknown function kye",
+		LintIssue{Severity: SeverityError, Location: "app.tmpl:2:3", Message: "unknown function kye"}.String())
+	assert.Equal(t, "warning: key a doesn't exist", LintIssue{Severity: SeverityWarning, Message: "key a doesn't exist"}.String())
+}
@@ -2,9 +2,11 @@ package pkg
 
 import (
 	"bytes"
-	"io/ioutil"
+	"fmt"
 	"math/rand"
+	"os/exec"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -12,56 +14,278 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// reconnectInterval is how long subscribe waits between attempts to reestablish the subscription.
+const reconnectInterval = time.Second
+
 // subscribe listens to redis waiting for messages to be published. Any errors encountered are sent to the errorsOut
-// channel. When a message is returned from redis it is set to the messagesOut channel.
+// channel. When a message is returned from redis it is set to the messagesOut channel. If the subscription fails it is
+// reestablished, up to cfg.ReconnectAttempts times in a row, before the error is sent.
 func subscribe(cfg Config, messagesOut chan redis.Message, errorsOut chan error) {
+	attempts := 0
+	for {
+		subscribed, err := receive(cfg, messagesOut, attempts > 0)
+		if subscribed {
+			attempts = 0
+		}
+
+		if attempts >= cfg.ReconnectAttempts {
+			errorsOut <- err
+			return
+		}
+
+		attempts++
+		cfg.Logger.WithError(err).WithField("attempt", attempts).Warn("subscription failed, reconnecting")
+		time.Sleep(reconnectInterval)
+	}
+}
+
+// receive subscribes to the channel and sends the messages received to messagesOut, until the connection fails. It
+// reports whether the subscription was established. If reconnecting, a message is sent once subscribed to trigger an
+// update, as messages may have been published while disconnected.
+func receive(cfg Config, messagesOut chan redis.Message, reconnecting bool) (bool, error) {
 	// the pubsub subscriber needs to be in its own connection. Redis prevents connections subscribed to a channel to
 	// from doing anything besides the channel operations.
 	c, err := cfg.Pool.Dial()
 	if err != nil {
-		errorsOut <- err
-		return
+		return false, err
 	}
 
 	psc := &redis.PubSubConn{Conn: c}
-	if err := psc.Subscribe(RedisTemplateChannel); err != nil {
-		errorsOut <- err
-		return
+	defer psc.Close()
+	defer cfg.Status.pubsubDown()
+
+	if err := psc.Subscribe(cfg.channel()); err != nil {
+		return false, err
 	}
 
-	cfg.Logger.WithField("channel", RedisTemplateChannel).Info("subscribed to redis channel")
+	cfg.Logger.WithField("channel", cfg.channel()).Info("subscribed to redis channel")
+	cfg.Status.pubsubAlive()
 
-	for {
-		reply := psc.Receive()
-		cfg.Logger.WithField("reply", reply).Info("message received from redis")
+	// ping the connection periodically so that a connection that has silently died is noticed.
+	if cfg.Status != nil {
+		done := make(chan struct{})
+		defer close(done)
+
+		go ping(cfg, psc, done)
+	}
+
+	if reconnecting {
+		cfg.Metrics.reconnected()
+		messagesOut <- redis.Message{Channel: cfg.channel(), Data: []byte(".")}
+	}
 
-		switch v := reply.(type) {
+	for {
+		switch v := psc.Receive().(type) {
 		case redis.Message:
+			cfg.Logger.WithField("channel", v.Channel).Info("message received from redis")
+			if cfg.Trace {
+				cfg.Logger.WithFields(log.Fields{
+					"channel": v.Channel,
+					"payload": string(v.Data),
+				}).Debug("message payload")
+			}
+
+			cfg.Status.pubsubAlive()
+			cfg.Metrics.messageReceived(v.Channel)
 			messagesOut <- v
+		case redis.Pong:
+			cfg.Status.pubsubAlive()
 		case error:
-			errorsOut <- v
+			return true, v
+		}
+	}
+}
+
+// ping pings the pubsub connection until done is closed. The pongs are received by receive.
+func ping(cfg Config, psc *redis.PubSubConn, done chan struct{}) {
+	ticker := time.NewTicker(cfg.Status.pingInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := psc.Ping(""); err != nil {
+				cfg.Logger.WithError(err).Warn("failed to ping the pubsub connection")
+				return
+			}
+		case <-done:
 			return
 		}
 	}
 }
 
+// missingKeyRetryInterval is how often templates that are held waiting on missing keys are re-rendered. Keys are
+// normally seeded along with a publish, the retries catch keys that are written without one.
+const missingKeyRetryInterval = time.Second
+
+// queueMessages forwards the messages received on in to out, queueing them while out isn't being read, so that the
+// subscription keeps receiving, and its pings are answered, while the templates are updating. A message that is
+// already queued isn't queued again, as the update it causes renders every change published before it.
+func queueMessages(in chan redis.Message, out chan redis.Message) {
+	var queue []redis.Message
+	for {
+		if len(queue) == 0 {
+			queue = append(queue, <-in)
+			continue
+		}
+
+		select {
+		case message := <-in:
+			queued := false
+			for _, q := range queue {
+				if q.Channel == message.Channel && bytes.Equal(q.Data, message.Data) {
+					queued = true
+					break
+				}
+			}
+
+			if !queued {
+				queue = append(queue, message)
+			}
+		case out <- queue[0]:
+			queue = queue[1:]
+		}
+	}
+}
+
+// heldTemplate is a template whose first render is being held until the keys it is missing appear.
+type heldTemplate struct {
+	deadline time.Time
+	keys     []string
+}
+
+// holdTemplate starts holding the template if the error is a *MissingKeysError and holding is enabled. It reports
+// whether the template is now held.
+func holdTemplate(cfg Config, template Template, err error, held map[string]*heldTemplate) bool {
+	missing, ok := errors.Cause(err).(*MissingKeysError)
+	if !ok || cfg.MissingKeyWait <= 0 {
+		return false
+	}
+
+	held[template.SourceTemplate.Name()] = &heldTemplate{
+		deadline: time.Now().Add(cfg.MissingKeyWait),
+		keys:     missing.Keys,
+	}
+
+	cfg.Logger.WithFields(log.Fields{
+		"template": template.SourceTemplate.Name(),
+		"keys":     missing.Keys,
+		"wait":     cfg.MissingKeyWait,
+	}).Warn("holding template until its missing keys appear")
+
+	return true
+}
+
+// executeHeldTemplate retries a template that is held waiting on missing keys. Once the keys appear the template is
+// released. If they haven't appeared by the deadline the template either fails, or is rendered with the missing keys
+// empty if MissingKeyFallback is set.
+func executeHeldTemplate(cfg Config, template Template, held map[string]*heldTemplate, previousTemplateExecutions map[string]string, mut sync.Locker) error {
+	name := template.SourceTemplate.Name()
+	h := held[name]
+
+	err := executeTemplate(cfg, template, previousTemplateExecutions, mut)
+	missing, ok := errors.Cause(err).(*MissingKeysError)
+	if !ok {
+		delete(held, name)
+		if err == nil {
+			cfg.Logger.WithField("template", name).Info("missing keys appeared, template released")
+		}
+
+		return err
+	}
+
+	if time.Now().Before(h.deadline) {
+		if !equalStrings(h.keys, missing.Keys) {
+			h.keys = missing.Keys
+			cfg.Logger.WithFields(log.Fields{
+				"template": name,
+				"keys":     missing.Keys,
+			}).Warn("template is still waiting for missing keys")
+		}
+
+		return nil
+	}
+
+	delete(held, name)
+
+	if !cfg.MissingKeyFallback {
+		return errors.Wrapf(err, "gave up waiting for missing keys after %s", cfg.MissingKeyWait)
+	}
+
+	cfg.Logger.WithFields(log.Fields{
+		"template": name,
+		"keys":     missing.Keys,
+	}).Warn("gave up waiting for missing keys, rendering them empty")
+
+	// the fallback lasts as long as the template, so that the next update doesn't fail on the same keys.
+	template.state.setLenient()
+	return executeTemplate(cfg, template, previousTemplateExecutions, mut)
+}
+
+// equalStrings reports whether the two slices hold the same strings in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reportUpdate runs the update, reporting the state of the templates to the fleet once it has completed, whether it
+// succeeded or not.
+func reportUpdate(cfg Config, update func() error) error {
+	if err := cfg.Fleet.beginUpdate(cfg.Pool); err != nil {
+		cfg.Logger.WithError(err).Warn("failed to get the generation being rendered")
+	}
+
+	err := update()
+	if err := cfg.Fleet.report(cfg.Pool, true); err != nil {
+		cfg.Logger.WithError(err).Warn("failed to report the state of the templates")
+	}
+
+	return err
+}
+
 // update renders the templates, and waits.
-func update(cfg Config, previousTemplateExecutions map[string]string, mut sync.Locker) error {
+func update(cfg Config, held map[string]*heldTemplate, previousTemplateExecutions map[string]string, mut sync.Locker) error {
+	return reportUpdate(cfg, func() error {
+		return renderTemplates(cfg, held, previousTemplateExecutions, mut)
+	})
+}
+
+// renderTemplates renders every template, after waiting for the splay.
+func renderTemplates(cfg Config, held map[string]*heldTemplate, previousTemplateExecutions map[string]string, mut sync.Locker) error {
 	cfg.Logger.Debug("reloading Templates")
+	cfg.Metrics.updated()
 
 	// wait for a random time from 0 seconds up to the duration specified by splay.
 	splayMs := int64(cfg.Splay / time.Millisecond)
 	randomWaitMS := int64(rand.Float64() * float64(splayMs))
 	randomWait := time.Duration(randomWaitMS) * time.Millisecond
-	cfg.Logger.Debug("splay sleeping for: ", randomWait)
+	cfg.Logger.WithField("duration_ms", durationMS(randomWait)).Debug("splay sleeping")
 	time.Sleep(randomWait)
 
 	// iterate over all of the templates and execute them. If any of them have changed, write the new templated
 	// file to disk and perform the action (if it exists).
 	for _, template := range cfg.Templates {
-		cfg.Logger.Debug("executing template: ", template.SourceTemplate)
-		if err := executeTemplate(template, cfg.Logger, previousTemplateExecutions, mut); err != nil {
-			cfg.Logger.WithError(err).Error("failed to execute the template")
+		logger := cfg.Logger.WithField("template", template.SourceTemplate.Name())
+		if _, ok := held[template.SourceTemplate.Name()]; ok {
+			if err := executeHeldTemplate(cfg, template, held, previousTemplateExecutions, mut); err != nil {
+				logger.WithError(err).Error("failed to execute the template")
+				return errors.WithStack(err)
+			}
+
+			continue
+		}
+
+		if err := executeTemplate(cfg, template, previousTemplateExecutions, mut); err != nil {
+			logger.WithError(err).Error("failed to execute the template")
 			return errors.WithStack(err)
 		}
 	}
@@ -69,6 +293,143 @@ func update(cfg Config, previousTemplateExecutions map[string]string, mut sync.L
 	return nil
 }
 
+// executeNewTemplate executes a template for the first time. If the template is missing keys it is held until they
+// appear, if holding is enabled.
+func executeNewTemplate(cfg Config, template Template, held map[string]*heldTemplate, previousTemplateExecutions map[string]string, mut sync.Locker) error {
+	err := executeTemplate(cfg, template, previousTemplateExecutions, mut)
+	if err != nil && holdTemplate(cfg, template, err, held) {
+		return nil
+	}
+
+	return err
+}
+
+// reconfigure replaces the templates being processed with the given templates, returning the templates to process.
+// Templates that are unchanged are kept along with their state, while new and changed templates are executed.
+func reconfigure(cfg Config, templates []Template, held map[string]*heldTemplate, previousTemplateExecutions map[string]string, mut sync.Locker) ([]Template, error) {
+	previous := map[string]Template{}
+	for _, template := range cfg.Templates {
+		previous[template.SourceTemplate.Name()] = template
+	}
+
+	var changed []Template
+	merged := make([]Template, len(templates))
+	for i, template := range templates {
+		name := template.SourceTemplate.Name()
+		if old, ok := previous[name]; ok && old.unchanged(template) {
+			merged[i] = old
+		} else {
+			// the outputs of the old template are kept so that they can be pruned.
+			if ok {
+				template.state.setOutputs(old.state.getOutputs())
+			}
+
+			merged[i] = template
+			changed = append(changed, template)
+		}
+
+		delete(previous, name)
+	}
+
+	// anything left in previous has been removed.
+	mut.Lock()
+	for name := range previous {
+		delete(previousTemplateExecutions, name)
+	}
+	mut.Unlock()
+
+	for name, template := range previous {
+		delete(held, name)
+
+		if template.flag.Prune {
+			if err := template.removeAllOutputs(); err != nil {
+				cfg.Logger.WithError(err).WithField("template", name).Warn("failed to remove the outputs of a removed template")
+			}
+		}
+	}
+
+	cfg.Logger.WithFields(log.Fields{
+		"templates": len(merged),
+		"changed":   len(changed),
+		"removed":   len(previous),
+	}).Info("reconfigured templates")
+
+	cfg.Templates = merged
+	cfg.Fleet.setTemplates(merged)
+	if err := cfg.Status.setTemplates(merged); err != nil {
+		cfg.Logger.WithError(err).Warn("failed to update the ready file")
+	}
+
+	for _, template := range changed {
+		delete(held, template.SourceTemplate.Name())
+		if err := executeNewTemplate(cfg, template, held, previousTemplateExecutions, mut); err != nil {
+			return merged, errors.WithStack(err)
+		}
+	}
+
+	return merged, nil
+}
+
+// watchTemplates watches the files of every template.
+func watchTemplates(watcher *fileWatcher, templates []Template) error {
+	for _, template := range templates {
+		if err := watcher.watch(template.files()...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reparseTemplates parses every template that uses the changed file again and renders it, returning the templates to
+// process. Templates that fail to parse are logged and left as they were.
+func reparseTemplates(cfg Config, path string, held map[string]*heldTemplate, previousTemplateExecutions map[string]string, mut sync.Locker) ([]Template, error) {
+	templates := append([]Template{}, cfg.Templates...)
+
+	var reparsed []Template
+	for i, template := range templates {
+		if !template.uses(path) {
+			continue
+		}
+
+		logger := cfg.Logger.WithFields(log.Fields{
+			"template": template.SourceTemplate.Name(),
+			"file":     path,
+		})
+
+		updated, err := template.reparse()
+		if err != nil {
+			logger.WithError(err).Error("failed to parse the changed template, keeping the last good template")
+			continue
+		}
+
+		logger.Info("template changed")
+		templates[i] = updated
+		reparsed = append(reparsed, updated)
+	}
+
+	cfg.Templates = templates
+	cfg.Fleet.setTemplates(templates)
+	if err := cfg.Status.setTemplates(templates); err != nil {
+		cfg.Logger.WithError(err).Warn("failed to update the ready file")
+	}
+
+	for _, template := range reparsed {
+		var err error
+		if _, ok := held[template.SourceTemplate.Name()]; ok {
+			err = executeHeldTemplate(cfg, template, held, previousTemplateExecutions, mut)
+		} else {
+			err = executeTemplate(cfg, template, previousTemplateExecutions, mut)
+		}
+
+		if err != nil {
+			return templates, errors.WithStack(err)
+		}
+	}
+
+	return templates, nil
+}
+
 // Listen listens to the redis pubsub channel and when it detects any changes it will rerun all of its templates. If
 // the results of the templates have changed then the new templated results is written to disk and the templates action
 // is performed. If the template target is nil then the results are not persisted to disk.
@@ -79,26 +440,182 @@ func Listen(cfg Config) error {
 
 	mut := &sync.Mutex{}
 
+	// held contains the templates whose first render is waiting on missing keys.
+	held := map[string]*heldTemplate{}
+
+	cfg.Fleet.setTemplates(cfg.Templates)
+	if err := cfg.Status.setTemplates(cfg.Templates); err != nil {
+		cfg.Logger.WithError(err).Warn("failed to update the ready file")
+	}
+
+	if cfg.Cache != nil {
+		go cfg.Cache.run(cfg.Pool, cfg.Logger)
+	}
+
+	if cfg.Fleet != nil {
+		done := make(chan struct{})
+		defer close(done)
+
+		go heartbeat(cfg, done)
+	}
+
+	// the node campaigns before the initial render, so that the leader runs the commands it renders.
+	if cfg.Election != nil {
+		cfg.Election.campaignLogged(cfg.Logger)
+
+		done := make(chan struct{})
+		defer close(done)
+		defer func() {
+			if err := cfg.Election.resign(); err != nil {
+				cfg.Logger.WithError(err).Warn("failed to resign the leadership")
+			}
+		}()
+
+		go cfg.Election.run(cfg.Logger, done)
+	}
+
 	// perform the initial execution; building all of the templates, writing all to disk, and executing all possible
 	// actions.
-	for _, template := range cfg.Templates {
-		if err := executeTemplate(template, cfg.Logger, previousTemplateExecutions, mut); err != nil {
-			return errors.WithStack(err)
+	err := reportUpdate(cfg, func() error {
+		for _, template := range cfg.Templates {
+			if err := executeNewTemplate(cfg, template, held, previousTemplateExecutions, mut); err != nil {
+				return errors.WithStack(err)
+			}
 		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	retry := time.NewTicker(missingKeyRetryInterval)
+	defer retry.Stop()
+
 	messageChan := make(chan redis.Message)
 	errorChan := make(chan error)
+	fileChan := make(chan string)
+
+	var watcher *fileWatcher
+	if cfg.WatchTemplates {
+		var err error
+		if watcher, err = newFileWatcher(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := watchTemplates(watcher, cfg.Templates); err != nil {
+			return errors.WithStack(err)
+		}
+
+		go func() {
+			errorChan <- watcher.run(fileChan)
+		}()
+	}
 
-	go subscribe(cfg, messageChan, errorChan)
+	// rewatch watches any files the templates have started to use.
+	rewatch := func() {
+		if watcher == nil {
+			return
+		}
+
+		if err := watchTemplates(watcher, cfg.Templates); err != nil {
+			cfg.Logger.WithError(err).Error("failed to watch the template files")
+		}
+	}
+
+	received := make(chan redis.Message)
+	go queueMessages(received, messageChan)
+	go subscribe(cfg, received, errorChan)
 
 	for {
 		select {
-		case <-messageChan:
-			if err := update(cfg, previousTemplateExecutions, mut); err != nil {
+		case message := <-messageChan:
+			addressed, err := addressedTo(message.Data, cfg.Node, cfg.Tags)
+			if err != nil {
+				cfg.Logger.WithError(err).Warn("invalid selector, rendering the templates")
+			}
+
+			// the change isn't for this node, which is as up to date as it needs to be.
+			if !addressed {
+				cfg.Logger.Debug("ignored a message addressed to other nodes")
+				reportUpdate(cfg, func() error { return nil })
+				continue
+			}
+
+			if err := update(cfg, held, previousTemplateExecutions, mut); err != nil {
 				cfg.Logger.WithError(err).Error("fatal error occurred updated templates")
 				return errors.WithStack(err)
 			}
+
+			// renders may have included new files.
+			rewatch()
+		case <-cfg.Reload:
+			cfg.Logger.Info("reload requested")
+			if err := update(cfg, held, previousTemplateExecutions, mut); err != nil {
+				cfg.Logger.WithError(err).Error("fatal error occurred updated templates")
+				return errors.WithStack(err)
+			}
+		case templates := <-cfg.Reconfigure:
+			var err error
+			cfg.Templates, err = reconfigure(cfg, templates, held, previousTemplateExecutions, mut)
+			if err != nil {
+				cfg.Logger.WithError(err).Error("fatal error occurred reconfiguring templates")
+				return errors.WithStack(err)
+			}
+
+			rewatch()
+		case path := <-fileChan:
+			var err error
+			cfg.Templates, err = reparseTemplates(cfg, path, held, previousTemplateExecutions, mut)
+			if err != nil {
+				cfg.Logger.WithError(err).Error("fatal error occurred updated templates")
+				return errors.WithStack(err)
+			}
+
+			rewatch()
+		case <-cfg.ForceReload:
+			cfg.Logger.Info("forced reload requested")
+
+			// forgetting the previous executions causes every template to be written and every action to be run.
+			mut.Lock()
+			for name := range previousTemplateExecutions {
+				delete(previousTemplateExecutions, name)
+			}
+			mut.Unlock()
+
+			if err := update(cfg, held, previousTemplateExecutions, mut); err != nil {
+				cfg.Logger.WithError(err).Error("fatal error occurred updated templates")
+				return errors.WithStack(err)
+			}
+		case <-retry.C:
+			for _, template := range cfg.Templates {
+				if _, ok := held[template.SourceTemplate.Name()]; !ok {
+					continue
+				}
+
+				if err := executeHeldTemplate(cfg, template, held, previousTemplateExecutions, mut); err != nil {
+					cfg.Logger.WithError(err).WithField("template", template.SourceTemplate.Name()).
+						Error("failed to execute the held template")
+					return errors.WithStack(err)
+				}
+			}
+
+			// templates waiting for a lease of their rollout try to get one again, and the commands skipped while
+			// another node led are run once this node leads.
+			for _, template := range cfg.Templates {
+				if !template.state.isWaitingForLease() && !template.commandPending(cfg.Election) {
+					continue
+				}
+
+				err := reportUpdate(cfg, func() error {
+					return executeTemplate(cfg, template, previousTemplateExecutions, mut)
+				})
+				if err != nil {
+					cfg.Logger.WithError(err).WithField("template", template.SourceTemplate.Name()).
+						Error("failed to execute the template")
+					return errors.WithStack(err)
+				}
+			}
 		case err := <-errorChan:
 			cfg.Logger.WithError(err).Error("fatal error encountered in subscription")
 			return errors.WithStack(err)
@@ -108,37 +625,154 @@ func Listen(cfg Config) error {
 
 // executeTemplate executes the specified template, writes its output to the specified file, and then executes the
 // action. All these actions are blocking. The given mutex synchronizes access to the previousTemplateExecutions map.
-func executeTemplate(template Template, logger *log.Logger, previousTemplateExecutions map[string]string, mut sync.Locker) error {
+func executeTemplate(cfg Config, template Template, previousTemplateExecutions map[string]string, mut sync.Locker) error {
 	key := template.SourceTemplate.Name()
 
-	logger.WithField("template", key).Info("executing template")
+	logger := cfg.Logger.WithField("template", key)
+	if template.Target != nil {
+		logger = logger.WithField("target", *template.Target)
+	}
+
+	logger.Info("executing template")
 
 	buffer := bytes.NewBuffer(nil)
-	if err := template.SourceTemplate.Execute(buffer, nil); err != nil {
+	start := time.Now()
+	result, err := template.renderWith(buffer, cfg.renderOptions())
+	duration := time.Since(start)
+	cfg.Metrics.renderCompleted(key, duration, err)
+	if err != nil {
+		cfg.Status.renderFailed(key, err)
+		cfg.Fleet.renderFailed(key, err)
 		return err
 	}
 
+	fields := log.Fields{"duration_ms": durationMS(duration)}
+	if cfg.Cache != nil {
+		fields["cache_hits"] = result.cacheHits
+		fields["cache_misses"] = result.cacheMisses
+	}
+
+	if len(result.files) > 0 {
+		fields["files"] = len(result.files)
+	}
+
+	logger.WithFields(fields).Debug("rendered template")
+
 	mut.Lock()
 	previousValue := previousTemplateExecutions[key]
 	mut.Unlock()
 
-	if previousValue != buffer.String() {
-		// if there is a template target.
-		if template.Target != nil {
-			if err := ioutil.WriteFile(*template.Target, buffer.Bytes(), 0666); err != nil {
+	// a follower that skipped the command of a changed template runs it once it becomes the leader.
+	output := renderedOutput(buffer.Bytes(), result.files)
+	changed := previousValue != output
+	if changed || template.commandPending(cfg.Election) {
+		reload := func() error {
+			if changed {
+				if err := template.writeOutputs(buffer.Bytes(), result, cfg.Channel); err != nil {
+					cfg.Fleet.renderFailed(key, err)
+					return err
+				}
+			}
+
+			var env []string
+			token, leads := cfg.Election.Leader()
+			if template.flag.RunOn == RunOnLeader {
+				if !leads {
+					logger.Debug("skipped the command, another node leads")
+					template.state.setCommandSkipped(true)
+					return nil
+				}
+
+				env = []string{fmt.Sprintf("%s=%d", FencingTokenEnv, token)}
+			}
+
+			template.state.setCommandSkipped(false)
+
+			start := time.Now()
+			err := template.executeWith(env)
+			duration := time.Since(start)
+			cfg.Metrics.commandCompleted(key, duration, exitCode(err))
+			cfg.Status.commandCompleted(key, err)
+			cfg.Fleet.commandCompleted(key, err)
+			logger.WithFields(log.Fields{
+				"exit_code":   exitCode(err),
+				"duration_ms": durationMS(duration),
+			}).Info("command completed")
+			if err != nil {
 				return errors.WithStack(err)
 			}
+
+			// the command may have raced a new leader, which the systems it changes can tell by its fencing token.
+			if current, stillLeads := cfg.Election.Leader(); template.flag.RunOn == RunOnLeader && (!stillLeads || current != token) {
+				return errors.Wrapf(ErrLeadershipLost, "fencing token %d", token)
+			}
+
+			return nil
+		}
+
+		var err error
+		if template.flag.Rolling.enabled() {
+			err = newRollout(template).run(logger, reload)
+		} else {
+			err = reload()
+		}
+
+		// the template is retried until it gets a lease, its output is only recorded once it's written.
+		if errors.Cause(err) == errLeaseUnavailable {
+			if !template.state.setWaitingForLease(true) {
+				logger.Info("waiting for a lease to reload")
+			}
+
+			return nil
+		}
+
+		template.state.setWaitingForLease(false)
+
+		// a halted rollout isn't fatal, the template is reloaded on the first update after the rollout is reset. Neither is
+		// losing the leadership, the command is run again if the node leads again on a later update.
+		if errors.Cause(err) == ErrRolloutHalted || errors.Cause(err) == ErrLeadershipLost {
+			logger.WithError(err).Error("failed to reload the template")
+			cfg.Status.renderFailed(key, err)
+			cfg.Fleet.renderFailed(key, err)
+			return nil
 		}
 
-		err := template.Execute()
 		if err != nil {
-			return errors.WithStack(err)
+			return err
 		}
 
 		mut.Lock()
-		previousTemplateExecutions[key] = buffer.String()
+		previousTemplateExecutions[key] = output
 		mut.Unlock()
+	} else {
+		template.state.setWaitingForLease(false)
+	}
+
+	cfg.Fleet.templateRendered(key, buffer.Bytes())
+	if err := cfg.Status.templateRendered(key, buffer.Bytes()); err != nil {
+		logger.WithError(err).Warn("failed to update the ready file")
 	}
 
 	return nil
 }
+
+// exitCode returns the exit code of the command that returned the error. Zero is returned if there is no error, and -1
+// if the error didn't come from the command exiting.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+
+	return -1
+}
+
+// durationMS returns the duration in milliseconds, for logging.
+func durationMS(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
@@ -1,11 +1,13 @@
 package pkg
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os/exec"
 	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	"sync"
@@ -313,3 +315,720 @@ func TestListen_WritingTemplate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestListen_HoldsMissingKeys tests that a template missing keys on its first render is held until the keys appear.
+func TestListen_HoldsMissingKeys(t *testing.T) {
+	const TestTemplate = "./test_files/held.tmpl"
+	const TestOutput = "./test_files/held.out"
+
+	env := SetupTestEnvironment(6376, t)
+	defer env.Cleanup()
+
+	err := ioutil.WriteFile(TestTemplate, []byte(`{{key "db:host"}}:{{key "db:port"}}`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := env.Pool.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actionCount := 0
+	mut := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	var listenErr error
+	go func() {
+		listenErr = Listen(Config{
+			Logger:         env.Logger,
+			Channel:        RedisTemplateChannel,
+			MissingKeyWait: time.Minute,
+			Templates: []Template{
+				MustTemplate(t, env.Pool, TemplateFlag{
+					Source: TestTemplate,
+					Target: TestOutput,
+				}, func() error {
+					mut.Lock()
+					actionCount++
+					mut.Unlock()
+					return nil
+				}),
+			},
+			Pool: env.Pool,
+		})
+
+		wg.Done()
+	}()
+
+	time.Sleep(time.Second)
+
+	mut.Lock()
+	cur := actionCount
+	mut.Unlock()
+	if cur != 0 {
+		t.Fatalf("action ran while keys were missing. expected: 0, actual: %d", cur)
+	}
+
+	_, err = conn.Do("MSET", "db:host", "localhost", "db:port", "5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Do("PUBLISH", RedisTemplateChannel, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait until the actionCount is incremented.
+	for {
+		mut.Lock()
+		cur := actionCount
+		mut.Unlock()
+
+		if cur == 1 {
+			break
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	actualBytes, err := ioutil.ReadFile(TestOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "localhost:5432", string(actualBytes))
+
+	env.Cleanup()
+	wg.Wait()
+
+	// check that there isn't an error or it was the EOF error.
+	if listenErr != nil && listenErr.Error() != "EOF" {
+		t.Fatal(listenErr)
+	}
+}
+
+// TestUpdateKeys tests that keys are set and a single notification is published.
+// TestQueueMessages tests that messages are received while the listener is busy, and that repeats of a queued
+// message are dropped.
+func TestQueueMessages(t *testing.T) {
+	in, out := make(chan redis.Message), make(chan redis.Message)
+	go queueMessages(in, out)
+
+	// none of the sends block, although nothing is reading out.
+	for _, data := range []string{"a", "b", "a", "b"} {
+		select {
+		case in <- redis.Message{Channel: RedisTemplateChannel, Data: []byte(data)}:
+		case <-time.After(time.Second):
+			t.Fatal("sending the message blocked")
+		}
+	}
+
+	assert.Equal(t, "a", string((<-out).Data))
+	assert.Equal(t, "b", string((<-out).Data))
+
+	select {
+	case message := <-out:
+		t.Fatalf("unexpected message %s", message.Data)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestUpdateKeys(t *testing.T) {
+	env := SetupTestEnvironment(6375, t)
+	defer env.Cleanup()
+
+	c, err := env.Pool.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(RedisTemplateChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the subscription to be confirmed.
+	if _, ok := psc.Receive().(redis.Subscription); !ok {
+		t.Fatal("failed to subscribe")
+	}
+
+	err = UpdateKeys(env.Pool, RedisTemplateChannel, map[string]string{
+		"db:host": "localhost",
+		"db:port": "5432",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := psc.Receive().(redis.Message); !ok {
+		t.Fatal("no notification was published")
+	}
+
+	conn, err := env.Pool.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := redis.Strings(conn.Do("MGET", "db:host", "db:port"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"localhost", "5432"}, values)
+}
+
+func TestTemplate_RenderWritesFiles(t *testing.T) {
+	env := SetupTestEnvironment(6374, t)
+	defer env.Cleanup()
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		if _, err := conn.Do("HSET", "vhosts:"+host, "root", "/srv/"+host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const TestSource = "./test_files/vhosts.tmpl"
+	err := ioutil.WriteFile(TestSource, []byte(
+		`{{ range ls "vhosts:" }}{{ writeFile (printf "%s.conf" .) (index (hash (printf "vhosts:%s" .)) "root") }}{{ end }}`,
+	), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := MustTemplate(t, env.Pool, TemplateFlag{Source: TestSource, DestinationDir: "./test_files/vhosts"}, nil)
+
+	buffer := bytes.NewBuffer(nil)
+	result, err := template.renderWith(buffer, renderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "", buffer.String())
+	assert.Equal(t, []renderedFile{
+		{name: "a.example.com.conf", contents: "/srv/a.example.com"},
+		{name: "b.example.com.conf", contents: "/srv/b.example.com"},
+	}, result.files)
+}
+
+func TestRedisSink(t *testing.T) {
+	env := SetupTestEnvironment(6373, t)
+	defer env.Cleanup()
+
+	sink := &RedisSink{Pool: env.Pool, Key: "derived:config", Channel: RedisTemplateChannel}
+	if err := sink.Write([]byte("rendered")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	value, err := redis.String(conn.Do("GET", "derived:config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "rendered", value)
+
+	// the derived key isn't counted as a change by an operator.
+	generation, err := conn.Do("GET", GenerationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, generation)
+}
+
+func TestSetKey_History(t *testing.T) {
+	env := SetupTestEnvironment(6372, t)
+	defer env.Cleanup()
+
+	opts := HistoryOptions{Author: "tester", MaxLen: 2}
+	for _, value := range []string{"a", "b", "c"} {
+		if err := SetKey(env.Pool, RedisTemplateChannel, "app:mode", value, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := History(env.Pool, "app:mode", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !assert.Len(t, entries, 2, "the history should be trimmed to the max length") {
+		return
+	}
+
+	assert.Equal(t, "tester", entries[0].Author)
+	assert.Equal(t, "b", *entries[0].Old)
+	assert.Equal(t, "c", *entries[0].New)
+
+	value, err := Rollback(env.Pool, RedisTemplateChannel, "app:mode", "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "b", *value)
+
+	value, err = Rollback(env.Pool, RedisTemplateChannel, "app:mode", entries[0].Version, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "c", *value)
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	current, err := redis.String(conn.Do("GET", "app:mode"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "c", current)
+}
+
+func TestPlanImport(t *testing.T) {
+	env := SetupTestEnvironment(6371, t)
+	defer env.Cleanup()
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	for key, value := range map[string]string{"app:db:host": "10.0.0.2", "app:old": "x", "apple:a": "y"} {
+		if _, err := conn.Do("SET", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := PlanImport(env.Pool, "app", map[string]Value{
+		"app:db:host": *StringValue("10.0.0.2"),
+		"app:db:port": *StringValue("5432"),
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []Change{{Key: "app:db:port", Value: StringValue("5432")}, {Key: "app:old"}}, changes)
+
+	if err := ApplyChanges(env.Pool, RedisTemplateChannel, changes, HistoryOptions{Author: "tester"}); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := redis.Values(conn.Do("MGET", "app:db:port", "app:old", "apple:a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []interface{}{[]byte("5432"), nil, []byte("y")}, values)
+}
+
+func TestExport(t *testing.T) {
+	env := SetupTestEnvironment(6370, t)
+	defer env.Cleanup()
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	commands := [][]interface{}{
+		{"SET", "app:db:host", "10.0.0.2"},
+		{"HSET", "app:tls", "cert", "/etc/tls.crt"},
+		{"RPUSH", "app:servers", "web2", "web1"},
+		{"SADD", "app:vhosts", "b.com", "a.com"},
+		{"ZADD", "app:weights", 2, "web1"},
+		{"SET", "apple", "x"},
+	}
+
+	for _, command := range commands {
+		if _, err := conn.Do(command[0].(string), command[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := SetKey(env.Pool, RedisTemplateChannel, "app:db:port", "5432", HistoryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := Export(env.Pool, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]Value{
+		"app:db:host": *StringValue("10.0.0.2"),
+		"app:db:port": *StringValue("5432"),
+		"app:tls":     {Type: TypeHash, Fields: map[string]string{"cert": "/etc/tls.crt"}},
+		"app:servers": {Type: TypeList, Members: []string{"web2", "web1"}},
+		"app:vhosts":  {Type: TypeSet, Members: []string{"a.com", "b.com"}},
+		"app:weights": {Type: TypeZSet, Scores: map[string]float64{"web1": 2}},
+	}, values)
+
+	// importing the export again changes nothing.
+	changes, err := PlanImport(env.Pool, "app", values, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, changes)
+}
+
+func TestLintTemplate_MissingKeys(t *testing.T) {
+	env := SetupTestEnvironment(6369, t)
+	defer env.Cleanup()
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", "db:host", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	source := "./test_files/lint.tmpl"
+	err := ioutil.WriteFile(source, []byte(`{{ key "db:host" }}:{{ keyOrDefault "db:port" "5432" }} {{ key "db:user" }}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := LintTemplate(TemplateFlag{Source: source}, env.Pool, nil)
+	assert.Equal(t, []string{"db:port", "db:user"}, report.Missing)
+	assert.Equal(t, []LintIssue{{Severity: SeverityError, Message: "key db:user doesn't exist"}}, report.Issues)
+
+	strict := false
+	report = LintTemplate(TemplateFlag{Source: source, Strict: &strict}, env.Pool, nil)
+	assert.Equal(t, 0, report.Errors())
+	assert.Equal(t, SeverityWarning, report.Issues[0].Severity)
+}
+
+func TestFleetStatus(t *testing.T) {
+	env := SetupTestEnvironment(6368, t)
+	defer env.Cleanup()
+
+	target := "app.conf"
+	tmpl := Template{SourceTemplate: template.New("app.tmpl"), Target: &target}
+
+	fleet := NewFleet("web1", time.Second)
+	fleet.setTemplates([]Template{tmpl})
+	if err := fleet.beginUpdate(env.Pool); err != nil {
+		t.Fatal(err)
+	}
+
+	fleet.templateRendered("app.tmpl", []byte("output"))
+	if err := fleet.report(env.Pool, true); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := FleetStatus(env.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(0), report.Generation)
+	assert.Len(t, report.Nodes, 1)
+	assert.Equal(t, NodeUpToDate, report.Nodes[0].State)
+
+	// publishing a change makes the node stale until it updates again.
+	if err := Publish(env.Pool, RedisTemplateChannel, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = FleetStatus(env.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(1), report.Generation)
+	assert.Equal(t, NodeStale, report.Nodes[0].State)
+
+	// the node is stale until the update rendering the change completes, whatever heartbeats it sends meanwhile.
+	if err := fleet.beginUpdate(env.Pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fleet.report(env.Pool, false); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = FleetStatus(env.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, NodeStale, report.Nodes[0].State)
+
+	if err := fleet.report(env.Pool, true); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = FleetStatus(env.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(1), report.Nodes[0].Generation)
+	assert.Equal(t, NodeUpToDate, report.Nodes[0].State)
+
+	// the report expires without a heartbeat.
+	time.Sleep(1500 * time.Millisecond)
+	report, err = FleetStatus(env.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, report.Nodes)
+}
+
+func TestRollout(t *testing.T) {
+	env := SetupTestEnvironment(6367, t)
+	defer env.Cleanup()
+
+	logger := logrus.NewEntry(logrus.New())
+	config := RollingConfig{MaxConcurrent: 1, LeaseTTL: Duration(time.Second), MaxFailures: 1}
+	web1 := rollout{pool: env.Pool, name: "nginx", holder: "web1", config: config, keys: keysOf("nginx")}
+	web2 := web1
+	web2.holder = "web2"
+
+	if err := web1.acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the only lease is held by web1, web2 doesn't wait for it.
+	assert.Equal(t, errLeaseUnavailable, errors.Cause(web2.acquire()))
+	assert.Equal(t, errLeaseUnavailable, errors.Cause(web2.run(logger, func() error { return nil })))
+
+	status, err := GetRollout(env.Pool, "nginx")
+	assert.NoError(t, err)
+	assert.Equal(t, RolloutStatus{Name: "nginx", Holders: []string{"web1"}}, status)
+
+	// a failed reload releases the lease and halts the rollout.
+	err = web1.run(logger, func() error { return errors.New("exit status 1") })
+	assert.Error(t, err)
+
+	assert.Equal(t, ErrRolloutHalted, errors.Cause(web2.acquire()))
+
+	status, err = GetRollout(env.Pool, "nginx")
+	assert.NoError(t, err)
+	assert.Equal(t, RolloutStatus{Name: "nginx", Holders: []string{}, Failures: 1, Halted: true}, status)
+
+	if err := ResetRollout(env.Pool, "nginx"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, web2.run(logger, func() error { return nil }))
+
+	// the failures of a generation don't count towards halting the rollout of the next one.
+	web1.config.MaxFailures, web2.config.MaxFailures = 2, 2
+	assert.Error(t, web1.run(logger, func() error { return errors.New("exit status 1") }))
+
+	if err := Publish(env.Pool, RedisTemplateChannel, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, web2.run(logger, func() error { return errors.New("exit status 1") }))
+
+	status, err = GetRollout(env.Pool, "nginx")
+	assert.NoError(t, err)
+	assert.Equal(t, RolloutStatus{Name: "nginx", Holders: []string{}, Failures: 1}, status)
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int64(conn.Do("PTTL", web1.keys.failuresOf(1)))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0, "the failures should expire")
+}
+
+func TestElection(t *testing.T) {
+	env := SetupTestEnvironment(6366, t)
+	defer env.Cleanup()
+
+	web1 := NewElection(env.Pool, "default", "web1", time.Second)
+	web2 := NewElection(env.Pool, "default", "web2", time.Second)
+
+	token, err := web1.campaign()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), token)
+
+	// web1 leads, so web2 can't take the leadership.
+	token, err = web2.campaign()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), token)
+
+	_, leads := web2.Leader()
+	assert.False(t, leads)
+
+	// renewing the leadership keeps the fencing token.
+	token, err = web1.campaign()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), token)
+
+	status, err := GetLeader(env.Pool, "default")
+	assert.NoError(t, err)
+	assert.Equal(t, LeaderStatus{Name: "default", ID: "web1", FencingToken: 1}, status)
+
+	// web2 can't resign for web1.
+	assert.NoError(t, web2.resign())
+	status, err = GetLeader(env.Pool, "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "web1", status.ID)
+
+	// a new leader gets a higher fencing token.
+	assert.NoError(t, web1.resign())
+	_, leads = web1.Leader()
+	assert.False(t, leads)
+
+	token, err = web2.campaign()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), token)
+
+	status, err = GetLeader(env.Pool, "default")
+	assert.NoError(t, err)
+	assert.Equal(t, LeaderStatus{Name: "default", ID: "web2", FencingToken: 2}, status)
+}
+
+func TestTemplate_RenderKeyPrefixes(t *testing.T) {
+	env := SetupTestEnvironment(6365, t)
+	defer env.Cleanup()
+
+	conn := env.Pool.Get()
+	defer conn.Close()
+
+	for key, value := range map[string]string{
+		"env:prod:db:host":   "prod.db",
+		"global:db:host":     "global.db",
+		"global:db:port":     "5432",
+		"env:prod:vhosts:b":  "b",
+		"global:vhosts:a":    "a",
+		"global:vhosts:b":    "global b",
+		"node:web-3:db:port": "6432",
+	} {
+		if _, err := conn.Do("SET", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const TestSource = "./test_files/prefixes.tmpl"
+	err := ioutil.WriteFile(TestSource, []byte(
+		`{{ key "db:host" }}:{{ key "db:port" }} {{ range ls "vhosts:" }}{{ . }}{{ end }}`,
+	), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := MustTemplate(t, env.Pool, TemplateFlag{Source: TestSource}, nil)
+	template.KeyPrefixes = []string{"node:web-3:", "env:prod:", "global:"}
+
+	buffer := bytes.NewBuffer(nil)
+	if err := template.Render(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "prod.db:6432 ab", buffer.String())
+
+	// the layers above the one a key resolved to are read, so that an override appearing later is noticed.
+	assert.Equal(t, []string{"node:web-3:db:host", "env:prod:db:host", "node:web-3:db:port"},
+		template.state.getDependencies())
+
+	if _, err := conn.Do("SET", "node:web-3:db:host", "local.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer.Reset()
+	if err := template.Render(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "local.db:6432 ab", buffer.String())
+}
+
+// TestListen_MissingKeyFallback tests that a template that gave up waiting for its missing keys keeps rendering them
+// empty on later updates, rather than failing.
+func TestListen_MissingKeyFallback(t *testing.T) {
+	const TestTemplate = "./test_files/fallback.tmpl"
+	const TestOutput = "./test_files/fallback.out"
+
+	env := SetupTestEnvironment(6364, t)
+	defer env.Cleanup()
+
+	err := ioutil.WriteFile(TestTemplate, []byte(`{{key "db:host"}}:{{key "db:port"}}`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := env.Pool.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Do("SET", "db:host", "localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	var listenErr error
+	go func() {
+		listenErr = Listen(Config{
+			Logger:             env.Logger,
+			Channel:            RedisTemplateChannel,
+			MissingKeyWait:     100 * time.Millisecond,
+			MissingKeyFallback: true,
+			Templates: []Template{
+				MustTemplate(t, env.Pool, TemplateFlag{Source: TestTemplate, Target: TestOutput}, nil),
+			},
+			Pool: env.Pool,
+		})
+
+		wg.Done()
+	}()
+
+	// waitForOutput waits until the template has written the output.
+	waitForOutput := func(expected string) {
+		for i := 0; i < 10; i++ {
+			if actual, err := ioutil.ReadFile(TestOutput); err == nil && string(actual) == expected {
+				return
+			}
+
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		t.Fatalf("the template never rendered %q", expected)
+	}
+
+	// the held template gives up after the wait, rendering the missing key empty.
+	waitForOutput("localhost:")
+
+	// the next update still renders the missing key empty, rather than failing.
+	if _, err := conn.Do("SET", "db:host", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Do("PUBLISH", RedisTemplateChannel, "."); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForOutput("127.0.0.1:")
+
+	if _, err := conn.Do("SET", "db:port", "5432"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Do("PUBLISH", RedisTemplateChannel, "."); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForOutput("127.0.0.1:5432")
+
+	env.Cleanup()
+	wg.Wait()
+
+	// check that there isn't an error or it was the EOF error.
+	if listenErr != nil && listenErr.Error() != "EOF" {
+		t.Fatal(listenErr)
+	}
+}
@@ -0,0 +1,264 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricBuckets are the upper bounds, in seconds, of the buckets used by the duration histograms.
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a family of prometheus metrics sharing a name, and differing by the values of their labels.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// metricSeries is a single series of a metric, with a value for each of the metric's labels.
+type metricSeries struct {
+	labelValues []string
+
+	// value is the value of a counter or gauge.
+	value float64
+
+	// bucketCounts, sum and count are the state of a histogram. bucketCounts are not cumulative.
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// newMetric creates a metric of the given kind (counter, gauge or histogram).
+func newMetric(kind, name, help string, labels ...string) *metric {
+	m := &metric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*metricSeries{},
+	}
+
+	if kind == "histogram" {
+		m.buckets = metricBuckets
+	}
+
+	return m
+}
+
+// with returns the series with the given label values, creating it if it doesn't exist.
+func (m *metric) with(labelValues ...string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{
+			labelValues:  labelValues,
+			bucketCounts: make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+
+	return s
+}
+
+// observe records a value in a histogram series.
+func (m *metric) observe(value float64, labelValues ...string) {
+	s := m.with(labelValues...)
+	s.sum += value
+	s.count++
+
+	for i, bound := range m.buckets {
+		if value <= bound {
+			s.bucketCounts[i]++
+			break
+		}
+	}
+}
+
+// write writes the metric in the prometheus text format.
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+
+		names := append(append([]string{}, m.labels...), "le")
+		values := append(append([]string{}, s.labelValues...), "")
+
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.bucketCounts[i]
+			values[len(values)-1] = formatValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), cumulative)
+		}
+
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues), s.count)
+	}
+}
+
+// labelEscaper escapes label values as required by the prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the label pairs of a series, e.g. {template="foo"}.
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value.
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Metrics records what redis-template is doing, and serves it over http in the prometheus text format. A nil *Metrics
+// records nothing.
+type Metrics struct {
+	mut sync.Mutex
+
+	renders          *metric
+	renderFailures   *metric
+	renderDuration   *metric
+	lastRender       *metric
+	commands         *metric
+	commandDuration  *metric
+	updates          *metric
+	messagesReceived *metric
+	reconnects       *metric
+	redisDuration    *metric
+}
+
+// NewMetrics creates a new Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		renders: newMetric("counter", "redis_template_renders_total",
+			"Total number of template renders.", "template"),
+		renderFailures: newMetric("counter", "redis_template_render_failures_total",
+			"Total number of template renders that failed.", "template"),
+		renderDuration: newMetric("histogram", "redis_template_render_duration_seconds",
+			"Time taken to render templates.", "template"),
+		lastRender: newMetric("gauge", "redis_template_last_successful_render_timestamp_seconds",
+			"Unix time of the last successful render of a template.", "template"),
+		commands: newMetric("counter", "redis_template_commands_total",
+			"Total number of template commands run, by exit code.", "template", "exit_code"),
+		commandDuration: newMetric("histogram", "redis_template_command_duration_seconds",
+			"Time taken to run template commands.", "template"),
+		updates: newMetric("counter", "redis_template_updates_total",
+			"Total number of times the templates have been updated."),
+		messagesReceived: newMetric("counter", "redis_template_pubsub_messages_received_total",
+			"Total number of pubsub messages received.", "channel"),
+		reconnects: newMetric("counter", "redis_template_pubsub_reconnects_total",
+			"Total number of times the pubsub connection has been reestablished."),
+		redisDuration: newMetric("histogram", "redis_template_redis_command_duration_seconds",
+			"Latency of the redis commands issued while rendering.", "command"),
+	}
+}
+
+// record runs fn while holding the lock, doing nothing if m is nil.
+func (m *Metrics) record(fn func()) {
+	if m == nil {
+		return
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	fn()
+}
+
+// renderCompleted records a render of the template.
+func (m *Metrics) renderCompleted(template string, duration time.Duration, err error) {
+	m.record(func() {
+		m.renders.with(template).value++
+		m.renderDuration.observe(duration.Seconds(), template)
+		if err != nil {
+			m.renderFailures.with(template).value++
+			return
+		}
+
+		m.lastRender.with(template).value = float64(time.Now().UnixNano()) / float64(time.Second)
+	})
+}
+
+// commandCompleted records a run of the template's command.
+func (m *Metrics) commandCompleted(template string, duration time.Duration, exitCode int) {
+	m.record(func() {
+		m.commands.with(template, strconv.Itoa(exitCode)).value++
+		m.commandDuration.observe(duration.Seconds(), template)
+	})
+}
+
+// updated records an update of the templates.
+func (m *Metrics) updated() {
+	m.record(func() {
+		m.updates.with().value++
+	})
+}
+
+// messageReceived records a message received on the channel.
+func (m *Metrics) messageReceived(channel string) {
+	m.record(func() {
+		m.messagesReceived.with(channel).value++
+	})
+}
+
+// reconnected records the pubsub connection being reestablished.
+func (m *Metrics) reconnected() {
+	m.record(func() {
+		m.reconnects.with().value++
+	})
+}
+
+// redisCommand records the latency of a redis command.
+func (m *Metrics) redisCommand(command string, duration time.Duration) {
+	m.record(func() {
+		m.redisDuration.observe(duration.Seconds(), command)
+	})
+}
+
+// ServeHTTP implements http.Handler, writing the metrics in the prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.record(func() {
+		for _, metric := range []*metric{
+			m.renders, m.renderFailures, m.renderDuration, m.lastRender, m.commands, m.commandDuration, m.updates,
+			m.messagesReceived, m.reconnects, m.redisDuration,
+		} {
+			metric.write(w)
+		}
+	})
+}
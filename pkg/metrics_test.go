@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.renderCompleted("foo.tmpl", 20*time.Millisecond, nil)
+	metrics.renderCompleted("foo.tmpl", time.Second, errors.New("failed"))
+	metrics.commandCompleted("foo.tmpl", time.Millisecond, 3)
+	metrics.messageReceived(RedisTemplateChannel)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	assert.Contains(t, body, "# TYPE redis_template_renders_total counter\n")
+	assert.Contains(t, body, `redis_template_renders_total{template="foo.tmpl"} 2`)
+	assert.Contains(t, body, `redis_template_render_failures_total{template="foo.tmpl"} 1`)
+	assert.Contains(t, body, `redis_template_render_duration_seconds_bucket{template="foo.tmpl",le="0.025"} 1`)
+	assert.Contains(t, body, `redis_template_render_duration_seconds_bucket{template="foo.tmpl",le="+Inf"} 2`)
+	assert.Contains(t, body, `redis_template_render_duration_seconds_count{template="foo.tmpl"} 2`)
+	assert.Contains(t, body, `redis_template_commands_total{template="foo.tmpl",exit_code="3"} 1`)
+	assert.Contains(t, body, `redis_template_pubsub_messages_received_total{channel="redis-template-channel"} 1`)
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var metrics *Metrics
+	metrics.renderCompleted("foo.tmpl", time.Second, nil)
+	metrics.updated()
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, exitCode(nil))
+	assert.Equal(t, -1, exitCode(errors.New("failed")))
+
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	assert.Equal(t, 3, exitCode(errors.WithStack(err)))
+}
@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// renderedFile is a file written by a template with the writeFile function.
+type renderedFile struct {
+	name     string
+	contents string
+}
+
+// validOutputName returns an error if the name given to writeFile would escape the template's destination directory.
+func validOutputName(name string) error {
+	clean := filepath.Clean(name)
+	if name == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return errors.Errorf("invalid file name %q given to writeFile", name)
+	}
+
+	return nil
+}
+
+// sink returns where the output of the template is written. It is the template's Sink, or the file at its target.
+func (t Template) sink() Sink {
+	if t.Sink != nil {
+		return t.Sink
+	}
+
+	if t.Target != nil && *t.Target != "" {
+		return &FileSink{Path: *t.Target}
+	}
+
+	return nil
+}
+
+// outputDir returns the directory the files written with writeFile are written to. It is the template's destination
+// directory, or the directory of the file it writes to.
+func (t Template) outputDir() string {
+	if t.flag.DestinationDir != "" {
+		return t.flag.DestinationDir
+	}
+
+	if sink, ok := t.sink().(*FileSink); ok {
+		return filepath.Dir(sink.Path)
+	}
+
+	return ""
+}
+
+// manifestPath returns the file the outputs of a pruning template are recorded in, so that the files it wrote before
+// a restart are still pruned. It is hidden in the template's output directory, and named after its source.
+func (t Template) manifestPath() string {
+	dir := t.outputDir()
+	if dir == "" {
+		return ""
+	}
+
+	return filepath.Join(dir, "."+filepath.Base(t.SourceTemplate.Name())+".outputs")
+}
+
+// readManifest returns the outputs recorded in the manifest, or nothing if there isn't one.
+func readManifest(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var outputs []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line != "" {
+			outputs = append(outputs, line)
+		}
+	}
+
+	return outputs, nil
+}
+
+// writeManifest records the outputs in the manifest.
+func writeManifest(path string, outputs []string) error {
+	var contents bytes.Buffer
+	for _, output := range outputs {
+		fmt.Fprintln(&contents, output)
+	}
+
+	return errors.WithStack(ioutil.WriteFile(path, contents.Bytes(), 0644))
+}
+
+// renderedOutput returns a string that changes whenever any of the outputs of a render change, so that it can be
+// compared to the previous render.
+func renderedOutput(output []byte, files []renderedFile) string {
+	buffer := bytes.NewBuffer(nil)
+	buffer.Write(output)
+	for _, file := range files {
+		fmt.Fprintf(buffer, "\x00%s\x00%s", file.name, file.contents)
+	}
+
+	return buffer.String()
+}
+
+// writeOutputs writes the template's output to its sink, and the files written with writeFile to its destination
+// directory. A template that writes files and renders nothing but whitespace itself has its own output skipped. If the
+// template prunes, the files it wrote previously that it no longer writes are removed, including those recorded in its
+// manifest by the renders before a restart. The files written by renders
+// that read secrets are only readable by their owner, and are only written to other sinks if the template allows
+// secrets. Redis sinks without a channel of their own publish on the channel the listener subscribes to.
+func (t Template) writeOutputs(output []byte, result renderResult, channel string) error {
+	files := result.files
+
+	var written []string
+	if sink := t.sink(); sink != nil && (len(files) == 0 || len(bytes.TrimSpace(output)) > 0) {
+		if file, ok := sink.(*FileSink); ok && file.Mode == 0 && len(result.secrets) > 0 {
+			sink = &FileSink{Path: file.Path, Mode: secretFileMode}
+		}
+
+		if _, ok := sink.(*FileSink); !ok && len(result.secrets) > 0 && !t.AllowSecrets {
+			return errors.Errorf("template %s read secrets, which are only written to files unless it allows secrets",
+				t.SourceTemplate.Name())
+		}
+
+		if redisSink, ok := sink.(*RedisSink); ok && redisSink.listenerChannel {
+			sink = &RedisSink{Pool: redisSink.Pool, Key: redisSink.Key, Channel: channel}
+		}
+
+		// the listener would be notified of the write and render the template again, changing the key again.
+		redisSink, ok := sink.(*RedisSink)
+		if ok && redisSink.Channel == channel && contains(t.state.getDependencies(), redisSink.Key) {
+			return errors.Errorf("template %s reads the key %s that it writes to, which would notify itself forever",
+				t.SourceTemplate.Name(), redisSink.Key)
+		}
+
+		if err := sink.Write(output); err != nil {
+			return err
+		}
+
+		if file, ok := sink.(*FileSink); ok {
+			written = append(written, file.Path)
+		}
+	}
+
+	dir := t.outputDir()
+	if len(files) > 0 && dir == "" {
+		return errors.Errorf("template %s writes files but has no destination", t.SourceTemplate.Name())
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := writeOutputFile(path, []byte(file.contents), result.outputMode()); err != nil {
+			return err
+		}
+
+		written = append(written, path)
+	}
+
+	previous := t.state.setOutputs(written)
+	if !t.flag.Prune {
+		return nil
+	}
+
+	manifest := t.manifestPath()
+	if previous == nil && manifest != "" {
+		recorded, err := readManifest(manifest)
+		if err != nil {
+			return err
+		}
+
+		previous = recorded
+	}
+
+	if err := removeOutputs(previous, written); err != nil {
+		return err
+	}
+
+	if manifest == "" {
+		return nil
+	}
+
+	return writeManifest(manifest, written)
+}
+
+// removeAllOutputs removes every file written by the template, along with its manifest. It is used when a pruning
+// template is removed from the configuration.
+func (t Template) removeAllOutputs() error {
+	outputs := t.state.getOutputs()
+	manifest := t.manifestPath()
+	if manifest != "" {
+		recorded, err := readManifest(manifest)
+		if err != nil {
+			return err
+		}
+
+		outputs = append(outputs, recorded...)
+		outputs = append(outputs, manifest)
+	}
+
+	return removeOutputs(outputs, nil)
+}
+
+// writeOutputFile writes the contents to the file at the path, creating it with the mode. If the mode is restricted
+// from the default an existing file is changed to it before it is written, so that the contents are never readable
+// with a looser mode.
+func writeOutputFile(path string, contents []byte, mode os.FileMode) error {
+	if mode != 0666 {
+		if err := os.Chmod(path, mode); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	return errors.WithStack(ioutil.WriteFile(path, contents, mode))
+}
+
+// removeOutputs removes the files that aren't kept. Files that have already been removed are ignored.
+func removeOutputs(files []string, keep []string) error {
+	for _, file := range files {
+		if contains(keep, file) {
+			continue
+		}
+
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
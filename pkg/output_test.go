@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidOutputName(t *testing.T) {
+	assert.Nil(t, validOutputName("a.conf"))
+	assert.Nil(t, validOutputName("sites/a.conf"))
+	assert.NotNil(t, validOutputName(""))
+	assert.NotNil(t, validOutputName("/etc/passwd"))
+	assert.NotNil(t, validOutputName("../a.conf"))
+	assert.NotNil(t, validOutputName("sites/../../a.conf"))
+}
+
+func TestTemplate_WriteOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "vhosts")
+	tmpl := Template{
+		SourceTemplate: template.New("vhosts.tmpl"),
+		Target:         &target,
+		state:          &templateState{},
+		flag:           TemplateFlag{DestinationDir: dir, Prune: true},
+	}
+
+	err = tmpl.writeOutputs([]byte("\n"), renderResult{files: []renderedFile{
+		{name: "a.conf", contents: "a"},
+		{name: "b.conf", contents: "b"},
+	}}, RedisTemplateChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "a.conf"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(contents))
+
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err), "whitespace output of a template writing files should be skipped")
+
+	if err := tmpl.writeOutputs([]byte("\n"), renderResult{files: []renderedFile{{name: "a.conf", contents: "a"}}}, RedisTemplateChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "b.conf"))
+	assert.True(t, os.IsNotExist(err), "files no longer written should be pruned")
+
+	_, err = os.Stat(filepath.Join(dir, "a.conf"))
+	assert.Nil(t, err)
+
+	// after a restart the files written before it are still pruned.
+	restarted := tmpl
+	restarted.state = &templateState{}
+	if err := restarted.writeOutputs([]byte("\n"), renderResult{files: []renderedFile{{name: "c.conf", contents: "c"}}}, RedisTemplateChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "a.conf"))
+	assert.True(t, os.IsNotExist(err), "files written before a restart should be pruned")
+
+	if err := restarted.removeAllOutputs(); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, remaining, "the outputs and manifest of a removed template should be removed")
+}
+
+func TestEscapeGlob(t *testing.T) {
+	assert.Equal(t, `vhosts:\*\?\[a\]\\`, escapeGlob(`vhosts:*?[a]\`))
+}
+
+// TestWriteOutputs_RedisSinkReadsItsKey tests that a template isn't written to a key it reads, as its listener would be
+// notified of the write forever.
+func TestWriteOutputs_RedisSinkReadsItsKey(t *testing.T) {
+	sink, err := ParseSink("redis://derived:config", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := Template{
+		SourceTemplate: template.New("derived.tmpl"),
+		Sink:           sink,
+		state:          &templateState{dependencies: []string{"derived:config"}},
+	}
+
+	err = tmpl.writeOutputs([]byte("rendered"), renderResult{}, "custom-channel")
+	assert.EqualError(t, err, "template derived.tmpl reads the key derived:config that it writes to, which would notify itself forever")
+}
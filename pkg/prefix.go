@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// KeyPrefixData is the data the key prefixes are rendered with, so that a prefix can name the node, e.g.
+// node:{{.Hostname}}: or env:{{.Tags.env}}:.
+type KeyPrefixData struct {
+	Hostname string
+	Node     string
+	Tags     map[string]string
+}
+
+// RenderKeyPrefixes renders each of the key prefixes, which are templates, with the data. Prefixes referring to tags
+// the node doesn't have fail to render.
+func RenderKeyPrefixes(prefixes []string, data KeyPrefixData) ([]string, error) {
+	rendered := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		tmpl, err := template.New("key-prefix").Option("missingkey=error").Parse(prefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key prefix %s", prefix)
+		}
+
+		buffer := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(buffer, data); err != nil {
+			return nil, errors.Wrapf(err, "failed to render key prefix %s", prefix)
+		}
+
+		rendered = append(rendered, buffer.String())
+	}
+
+	return rendered, nil
+}
+
+// layerKeys returns the keys that the key is looked up as, one for each of the prefixes in order. Without prefixes the
+// key is looked up as it is.
+func layerKeys(prefixes []string, key string) []string {
+	if len(prefixes) == 0 {
+		return []string{key}
+	}
+
+	keys := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		keys[i] = prefix + key
+	}
+
+	return keys
+}
+
+// layerOverlay returns the overlay with each value also given for its key under the first key prefix, so that it is
+// read instead of the key under every prefix. The keys are kept as they are too, so that a key given with its prefix
+// is still read instead of that layer.
+func layerOverlay(prefixes []string, overlay map[string]Value) map[string]Value {
+	if overlay == nil || len(prefixes) == 0 {
+		return overlay
+	}
+
+	layered := make(map[string]Value, len(overlay)*2)
+	for key, value := range overlay {
+		layered[key] = value
+	}
+
+	for key, value := range overlay {
+		layered[prefixes[0]+key] = value
+	}
+
+	return layered
+}
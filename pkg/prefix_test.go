@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderKeyPrefixes(t *testing.T) {
+	data := KeyPrefixData{Hostname: "web-3.example.com", Node: "web-3", Tags: map[string]string{"env": "prod"}}
+
+	prefixes, err := RenderKeyPrefixes([]string{"node:{{.Hostname}}:", "env:{{.Tags.env}}:", "global:"}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node:web-3.example.com:", "env:prod:", "global:"}, prefixes)
+
+	_, err = RenderKeyPrefixes([]string{"region:{{.Tags.region}}:"}, data)
+	assert.Error(t, err)
+
+	_, err = RenderKeyPrefixes([]string{"node:{{.Hostname:"}, data)
+	assert.Error(t, err)
+}
+
+func TestLayerKeys(t *testing.T) {
+	assert.Equal(t, []string{"db:host"}, layerKeys(nil, "db:host"))
+	assert.Equal(t, []string{"env:prod:db:host", "global:db:host"}, layerKeys([]string{"env:prod:", "global:"}, "db:host"))
+}
+
+func TestLayerOverlay(t *testing.T) {
+	overlay := map[string]Value{"db:host": *StringValue("10.0.0.3")}
+	assert.Equal(t, overlay, layerOverlay(nil, overlay))
+	assert.Nil(t, layerOverlay([]string{"env:prod:"}, nil))
+
+	// the value is read instead of the key under the first prefix, and so under every prefix.
+	assert.Equal(t, map[string]Value{
+		"db:host":          *StringValue("10.0.0.3"),
+		"env:prod:db:host": *StringValue("10.0.0.3"),
+	}, layerOverlay([]string{"env:prod:", "global:"}, overlay))
+}
+
+func TestLoadFileConfig_KeyPrefixes(t *testing.T) {
+	const TestConfig = "./test_files/key_prefixes.json"
+
+	err := ioutil.WriteFile(TestConfig, []byte(`{"key_prefixes": ["node:{{.Hostname}}:", "global:"], "templates": []}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadFileConfig(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"node:{{.Hostname}}:", "global:"}, cfg.KeyPrefixes)
+}
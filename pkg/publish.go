@@ -0,0 +1,205 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Notification is the payload of the messages published when keys are changed. Listeners render every template
+// whatever the keys, and payloads that aren't notifications, such as ".", address every listener.
+type Notification struct {
+	// Keys are the keys that were changed. It is empty if the changed keys aren't known.
+	Keys []string `json:"keys"`
+
+	// Selector, if set, addresses the notification to the listeners it matches. The others ignore it.
+	Selector string `json:"selector,omitempty"`
+}
+
+// notification returns the payload of a notification that the keys have changed, addressed to the nodes matching the
+// selector.
+func notification(keys []string, selector Selector) string {
+	if keys == nil {
+		keys = []string{}
+	}
+
+	payload, _ := json.Marshal(Notification{Keys: keys, Selector: selector.String()})
+	return string(payload)
+}
+
+// Publish publishes a notification on the channel that the keys have changed, causing listeners to render their
+// templates.
+func Publish(p *redis.Pool, channel string, keys []string) error {
+	return PublishTo(p, channel, nil, keys)
+}
+
+// PublishTo publishes a notification on the channel that the keys have changed, causing the listeners matching the
+// selector to render their templates.
+func PublishTo(p *redis.Pool, channel string, selector Selector, keys []string) error {
+	c := p.Get()
+	defer c.Close()
+
+	if err := c.Send("MULTI"); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := sendNotification(c, channel, selector, keys); err != nil {
+		return err
+	}
+
+	_, err := c.Do("EXEC")
+	return errors.WithStack(err)
+}
+
+// sendNotification queues the commands publishing a notification that the keys have changed to the nodes matching the
+// selector, and counting the change in GenerationKey.
+func sendNotification(c redis.Conn, channel string, selector Selector, keys []string) error {
+	if err := c.Send("INCR", GenerationKey); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(c.Send("PUBLISH", channel, notification(keys, selector)))
+}
+
+// UpdateKeys sets the given keys and publishes a single notification on the channel. The keys are written and the
+// notification is published in one transaction, so listeners never render a mix of old and new values.
+func UpdateKeys(p *redis.Pool, channel string, values map[string]string) error {
+	c := p.Get()
+	defer c.Close()
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	if err := c.Send("MULTI"); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, key := range keys {
+		if err := c.Send("SET", key, values[key]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := sendNotification(c, channel, nil, keys); err != nil {
+		return err
+	}
+
+	_, err := c.Do("EXEC")
+	return errors.WithStack(err)
+}
+
+// Change is a change to a key. The key is replaced by Value if it isn't nil, the fields of the hash are set if Fields
+// isn't nil, and the key is deleted otherwise.
+type Change struct {
+	Key    string
+	Value  *Value
+	Fields map[string]string
+}
+
+// String describes the change, e.g. set db:host "10.0.0.2".
+func (c Change) String() string {
+	switch {
+	case c.Value != nil:
+		return fmt.Sprintf("set %s %s", c.Key, c.Value.describe())
+	case c.Fields != nil:
+		fields := make([]string, 0, len(c.Fields))
+		for field := range c.Fields {
+			fields = append(fields, field)
+		}
+
+		sort.Strings(fields)
+
+		description := "hset " + c.Key
+		for _, field := range fields {
+			description += fmt.Sprintf(" %s %s", field, strconv.Quote(c.Fields[field]))
+		}
+
+		return description
+	default:
+		return "del " + c.Key
+	}
+}
+
+// send queues the commands making the change.
+func (c Change) send(conn redis.Conn) error {
+	switch {
+	case c.Value != nil:
+		return c.Value.send(conn, c.Key)
+	case c.Fields != nil:
+		return conn.Send("HSET", redis.Args{c.Key}.AddFlat(c.Fields)...)
+	default:
+		return conn.Send("DEL", c.Key)
+	}
+}
+
+// ApplyChanges makes the changes in a single transaction, publishing one notification on the channel listing the
+// changed keys. Changes to strings are recorded in their history. The keys are watched while their old
+// values are read, and the transaction is retried if any of them are modified before it runs, so that the history is
+// never wrong.
+func ApplyChanges(p *redis.Pool, channel string, changes []Change, opts HistoryOptions) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(changes))
+	for i, change := range changes {
+		keys[i] = change.Key
+	}
+
+	c := p.Get()
+	defer c.Close()
+
+	for i := 0; i < maxChangeAttempts; i++ {
+		if _, err := c.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+			return errors.Wrap(err, "failed to watch keys")
+		}
+
+		// reading a key that isn't a string, such as a hash, returns nil.
+		old, err := redis.Values(c.Do("MGET", redis.Args{}.AddFlat(keys)...))
+		if err != nil {
+			return errors.Wrap(err, "failed to get keys")
+		}
+
+		if err := c.Send("MULTI"); err != nil {
+			return errors.WithStack(err)
+		}
+
+		for i, change := range changes {
+			if err := change.send(c); err != nil {
+				return errors.WithStack(err)
+			}
+
+			// only changes to strings, and deletions, are recorded in the history.
+			if change.Fields != nil || (change.Value != nil && change.Value.Type != TypeString) {
+				continue
+			}
+
+			if err := c.Send("XADD", historyArgs(change, old[i], opts)...); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if err := sendNotification(c, channel, nil, keys); err != nil {
+			return err
+		}
+
+		reply, err := c.Do("EXEC")
+		if err != nil {
+			return errors.Wrap(err, "failed to apply changes")
+		}
+
+		if reply != nil {
+			return nil
+		}
+	}
+
+	return ErrConcurrentChange
+}
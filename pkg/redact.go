@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minRedactedLength is the length of the shortest value that is redacted wherever it appears. Shorter values, such as
+// ports and booleans, would redact unrelated parts of the logs, so they're only redacted from fields that are exactly
+// the value.
+const minRedactedLength = 4
+
+// redacted replaces redacted values in the logs.
+const redacted = "[REDACTED]"
+
+// Redactor removes the values read from redis from the logs, so that secrets stored in redis never appear in them. Only
+// the values read by the last render of each template are redacted. A nil *Redactor redacts nothing.
+type Redactor struct {
+	mut sync.RWMutex
+
+	// renders are the values read by the last render of each template, by the template's source path.
+	renders map[string]*redactedValues
+}
+
+// NewRedactor creates a Redactor with no values.
+func NewRedactor() *Redactor {
+	return &Redactor{renders: map[string]*redactedValues{}}
+}
+
+// redactedValues are the values read by a render. Secrets are redacted wherever they appear however short they are.
+type redactedValues struct {
+	redactor *Redactor
+	values   map[string]bool
+}
+
+// begin starts a render of the template, replacing the values read by its last render with the values added to the
+// returned set.
+func (r *Redactor) begin(name string) *redactedValues {
+	if r == nil {
+		return nil
+	}
+
+	values := &redactedValues{redactor: r, values: map[string]bool{}}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.renders[name] = values
+	return values
+}
+
+// add adds a value to be redacted.
+func (v *redactedValues) add(value string) {
+	if v == nil || value == "" {
+		return
+	}
+
+	v.redactor.mut.Lock()
+	defer v.redactor.mut.Unlock()
+	if _, ok := v.values[value]; !ok {
+		v.values[value] = false
+	}
+}
+
+// addSecret adds a decrypted secret to be redacted.
+func (v *redactedValues) addSecret(value string) {
+	if v == nil || value == "" {
+		return
+	}
+
+	v.redactor.mut.Lock()
+	defer v.redactor.mut.Unlock()
+	v.values[value] = true
+}
+
+// redactString redacts the values from the string. A string that is exactly a value is redacted however short it is,
+// longer values and secrets are redacted wherever they appear.
+func (r *Redactor) redactString(s string) string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	var values []string
+	for _, render := range r.renders {
+		for value, secret := range render.values {
+			if value == s {
+				return redacted
+			}
+
+			if secret || len(value) >= minRedactedLength {
+				values = append(values, value)
+			}
+		}
+	}
+
+	// longer values are redacted first, so that a value containing another isn't partially left in the string.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		s = strings.Replace(s, value, redacted, -1)
+	}
+
+	return s
+}
+
+// redactEntry returns a copy of the entry with the values redacted from its message and fields.
+func (r *Redactor) redactEntry(entry *log.Entry) *log.Entry {
+	redactedEntry := *entry
+	redactedEntry.Message = r.redactString(entry.Message)
+	redactedEntry.Data = make(log.Fields, len(entry.Data))
+
+	for field, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			redactedEntry.Data[field] = r.redactString(value)
+		case error:
+			if message := r.redactString(value.Error()); message != value.Error() {
+				redactedEntry.Data[field] = message
+			} else {
+				redactedEntry.Data[field] = value
+			}
+		default:
+			redactedEntry.Data[field] = value
+		}
+	}
+
+	return &redactedEntry
+}
+
+// Formatter wraps the formatter, redacting the values from every entry before it's formatted.
+func (r *Redactor) Formatter(formatter log.Formatter) log.Formatter {
+	return &redactingFormatter{redactor: r, formatter: formatter}
+}
+
+// redactingFormatter is a log.Formatter that redacts the entries given to another log.Formatter.
+type redactingFormatter struct {
+	redactor  *Redactor
+	formatter log.Formatter
+}
+
+// Format implements the log.Formatter interface.
+func (f *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if f.redactor == nil {
+		return f.formatter.Format(entry)
+	}
+
+	return f.formatter.Format(f.redactor.redactEntry(entry))
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor_Formatter(t *testing.T) {
+	redactor := NewRedactor()
+	values := redactor.begin("db.tmpl")
+	values.add("hunter22")
+	values.add("80")
+
+	buffer := bytes.NewBuffer(nil)
+	logger := log.New()
+	logger.Out = buffer
+	logger.Formatter = redactor.Formatter(&log.JSONFormatter{})
+
+	logger.WithField("port", "80").WithField("timeout", "80s").Error("failed to connect with password hunter22")
+
+	assert.NotContains(t, buffer.String(), "hunter22")
+	assert.Contains(t, buffer.String(), `"port":"[REDACTED]"`)
+	assert.Contains(t, buffer.String(), `"timeout":"80s"`)
+	assert.Contains(t, buffer.String(), `"level":"error"`)
+}
+
+// TestRedactor_Escaped tests that values that are escaped by the formatter, such as multi-line keys, are redacted.
+func TestRedactor_Escaped(t *testing.T) {
+	const key = "-----BEGIN KEY-----\n\"quoted\\\"\n-----END KEY-----"
+
+	redactor := NewRedactor()
+	redactor.begin("tls.tmpl").add(key)
+
+	buffer := bytes.NewBuffer(nil)
+	logger := log.New()
+	logger.Out = buffer
+	logger.Formatter = redactor.Formatter(&log.JSONFormatter{})
+
+	logger.WithError(errors.Errorf("invalid key %s", key)).Error("failed to render " + key)
+
+	var fields map[string]string
+	if err := json.Unmarshal(buffer.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "failed to render [REDACTED]", fields["msg"])
+	assert.Equal(t, "invalid key [REDACTED]", fields["error"])
+}
+
+// TestRedactor_Secrets tests that secrets are redacted wherever they appear however short they are, and that longer
+// values are redacted before the values they contain.
+func TestRedactor_Secrets(t *testing.T) {
+	redactor := NewRedactor()
+	values := redactor.begin("db.tmpl")
+	values.addSecret("pw")
+	values.add("hunter22")
+	values.add("hunter2")
+
+	assert.Equal(t, "[REDACTED] is [REDACTED]", redactor.redactString("pw is hunter22"))
+}
+
+// TestRedactor_Renders tests that only the values read by the last render of each template are redacted.
+func TestRedactor_Renders(t *testing.T) {
+	redactor := NewRedactor()
+	redactor.begin("db.tmpl").add("hunter22")
+	redactor.begin("web.tmpl").add("s3cr3t!!")
+	redactor.begin("db.tmpl").add("correct-horse")
+
+	assert.Equal(t, "hunter22 [REDACTED] [REDACTED]", redactor.redactString("hunter22 s3cr3t!! correct-horse"))
+}
+
+func TestRedactor_Nil(t *testing.T) {
+	var redactor *Redactor
+	redactor.begin("db.tmpl").add("hunter22")
+
+	buffer := bytes.NewBuffer(nil)
+	logger := log.New()
+	logger.Out = buffer
+	logger.Formatter = redactor.Formatter(&log.JSONFormatter{})
+	logger.Error("hunter22")
+
+	assert.Contains(t, buffer.String(), "hunter22")
+}
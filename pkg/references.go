@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"sort"
+	"text/template/parse"
+)
+
+// TemplateReferences are the keys a template reads that are known without rendering it, found by walking its parse
+// tree. Keys computed while rendering, e.g. {{ key (printf "vhosts:%s" .) }}, can't be known.
+type TemplateReferences struct {
+	// Keys are the keys read by key, keyOrDefault, hash and secret.
+	Keys []string `json:"keys"`
+
+	// Defaulted are the keys that are only read by keyOrDefault, which renders its default if they don't exist.
+	Defaulted []string `json:"defaulted,omitempty"`
+
+	// Prefixes are the prefixes listed by ls.
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// References returns the keys the template, and the templates in its library, read with string literals.
+func (t Template) References() TemplateReferences {
+	var trees []*parse.Tree
+	for _, tmpl := range t.SourceTemplate.Templates() {
+		trees = append(trees, tmpl.Tree)
+	}
+
+	return treeReferences(trees)
+}
+
+// treeReferences returns the keys read with string literals by the parse trees.
+func treeReferences(trees []*parse.Tree) TemplateReferences {
+	keys := map[string]bool{}
+	defaulted := map[string]bool{}
+	required := map[string]bool{}
+	prefixes := map[string]bool{}
+
+	for _, tree := range trees {
+		if tree == nil {
+			continue
+		}
+
+		walkCommands(tree.Root, func(cmd *parse.CommandNode) {
+			name, ok := commandFunction(cmd)
+			if !ok || len(cmd.Args) < 2 {
+				return
+			}
+
+			argument, ok := cmd.Args[1].(*parse.StringNode)
+			if !ok {
+				return
+			}
+
+			switch name {
+			case "key", "hash", "secret":
+				keys[argument.Text] = true
+				required[argument.Text] = true
+			case "keyOrDefault":
+				keys[argument.Text] = true
+				defaulted[argument.Text] = true
+			case "ls":
+				prefixes[argument.Text] = true
+			}
+		})
+	}
+
+	// a key that is also read without a default must exist.
+	for key := range required {
+		delete(defaulted, key)
+	}
+
+	references := TemplateReferences{Keys: sortedKeys(keys), Prefixes: sortedKeys(prefixes)}
+	if len(defaulted) > 0 {
+		references.Defaulted = sortedKeys(defaulted)
+	}
+
+	return references
+}
+
+// sortedKeys returns the keys of the set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// commandFunction returns the name of the function a command calls, if it calls one.
+func commandFunction(cmd *parse.CommandNode) (string, bool) {
+	if len(cmd.Args) == 0 {
+		return "", false
+	}
+
+	identifier, ok := cmd.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		return "", false
+	}
+
+	return identifier.Ident, true
+}
+
+// walkCommands calls fn for every command in the parse tree, including the commands nested in the arguments of
+// other commands.
+func walkCommands(node parse.Node, fn func(*parse.CommandNode)) {
+	walkNodes(node, func(node parse.Node) {
+		if cmd, ok := node.(*parse.CommandNode); ok {
+			fn(cmd)
+		}
+	})
+}
+
+// walkNodes calls fn for every node in the parse tree.
+func walkNodes(node parse.Node, fn func(parse.Node)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+
+		fn(n)
+		for _, child := range n.Nodes {
+			walkNodes(child, fn)
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+
+		fn(n)
+		for _, cmd := range n.Cmds {
+			walkNodes(cmd, fn)
+		}
+	case *parse.ActionNode:
+		fn(n)
+		walkNodes(n.Pipe, fn)
+	case *parse.IfNode:
+		fn(n)
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		fn(n)
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		fn(n)
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		fn(n)
+		walkNodes(n.Pipe, fn)
+	case *parse.CommandNode:
+		fn(n)
+		for _, arg := range n.Args {
+			walkNodes(arg, fn)
+		}
+	default:
+		if node != nil {
+			fn(node)
+		}
+	}
+}
+
+// walkBranch walks the pipeline and both lists of an if, range or with.
+func walkBranch(n *parse.BranchNode, fn func(parse.Node)) {
+	walkNodes(n.Pipe, fn)
+	walkNodes(n.List, fn)
+	walkNodes(n.ElseList, fn)
+}
@@ -0,0 +1,783 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// MissingKeysError is returned when a strict template reads keys that don't exist in redis.
+type MissingKeysError struct {
+	Template string
+	Keys     []string
+}
+
+// Error implements the error interface.
+func (e *MissingKeysError) Error() string {
+	return fmt.Sprintf("template %s is missing keys: %s", e.Template, strings.Join(e.Keys, ", "))
+}
+
+// maxConsistentRenderAttempts is the number of times a consistent render is retried when the keys it read change
+// while it is rendering.
+const maxConsistentRenderAttempts = 10
+
+// ErrInconsistentRender is returned when a consistent render couldn't get a consistent snapshot of its keys within
+// maxConsistentRenderAttempts attempts.
+var ErrInconsistentRender = errors.New("keys kept changing while rendering the template")
+
+// templateState is the state of a template that is kept between renders.
+type templateState struct {
+	mut sync.Mutex
+
+	// dependencies are the keys read by the last render. They are prefetched at the start of the next render.
+	dependencies []string
+
+	// included are the files included by the last render.
+	included []string
+
+	// outputs are the files written by the last render that changed the template's output.
+	outputs []string
+
+	// lenient is set once a strict template has given up waiting for its missing keys, so that it renders them empty
+	// from then on.
+	lenient bool
+
+	// commandEnv are the environment variables added to the command's environment while executeWith runs it.
+	commandEnv []string
+
+	// commandSkipped is set when the command of a template that runs on the leader was skipped because another node
+	// led, until the command is run.
+	commandSkipped bool
+
+	// waitingForLease is set while the template's changed output is waiting for a lease of its rollout to be written.
+	waitingForLease bool
+}
+
+// setCommandEnv sets the environment variables added to the command's environment.
+func (s *templateState) setCommandEnv(env []string) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.commandEnv = env
+}
+
+// getCommandEnv returns the environment variables added to the command's environment.
+func (s *templateState) getCommandEnv() []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.commandEnv
+}
+
+// setCommandSkipped records whether the command was skipped because another node led.
+func (s *templateState) setCommandSkipped(skipped bool) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.commandSkipped = skipped
+}
+
+// isCommandSkipped reports whether the command was skipped because another node led, and hasn't been run since.
+func (s *templateState) isCommandSkipped() bool {
+	if s == nil {
+		return false
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.commandSkipped
+}
+
+// setWaitingForLease records whether the template is waiting for a lease of its rollout, returning whether it was.
+func (s *templateState) setWaitingForLease(waiting bool) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	was := s.waitingForLease
+	s.waitingForLease = waiting
+	return was
+}
+
+// isWaitingForLease reports whether the template is waiting for a lease of its rollout.
+func (s *templateState) isWaitingForLease() bool {
+	if s == nil {
+		return false
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.waitingForLease
+}
+
+// setLenient causes a strict template to render missing keys empty from then on.
+func (s *templateState) setLenient() {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.lenient = true
+}
+
+// isLenient reports whether a strict template renders missing keys empty.
+func (s *templateState) isLenient() bool {
+	if s == nil {
+		return false
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.lenient
+}
+
+// setDependencies records the keys read by a render.
+func (s *templateState) setDependencies(keys []string) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.dependencies = keys
+}
+
+// setIncluded records the files included by a render.
+func (s *templateState) setIncluded(files []string) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.included = files
+}
+
+// getIncluded returns the files included by the last render.
+func (s *templateState) getIncluded() []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.included
+}
+
+// setOutputs records the files written by a render, returning the files written previously.
+func (s *templateState) setOutputs(files []string) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	previous := s.outputs
+	s.outputs = files
+	return previous
+}
+
+// getOutputs returns the files written by the last render that changed the template's output.
+func (s *templateState) getOutputs() []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.outputs
+}
+
+// getDependencies returns the keys read by the last render.
+func (s *templateState) getDependencies() []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.dependencies
+}
+
+// render is the state of a single execution of a template. The template functions are bound to it, which allows the
+// keys that the template reads to be tracked.
+type render struct {
+	conn    redis.Conn
+	strict  bool
+	missing []string
+
+	// prefixes are the key prefixes that keys are looked up under, in order.
+	prefixes []string
+
+	// secretKey decrypts the values read by secret.
+	secretKey *SecretKey
+
+	// read are the keys read by the render, in the order they were first read.
+	read []string
+
+	// included are the files included by the render.
+	included []string
+
+	// files are the files written by the template with writeFile, in the order they were written.
+	files []renderedFile
+
+	// values are the keys that were prefetched before the template was executed. Keys that were prefetched but don't
+	// exist are stored as nil.
+	values map[string]*string
+
+	// overlay are values that are read instead of the values of the keys in redis, e.g. to preview a change.
+	overlay map[string]Value
+
+	// watch causes every key to be watched before it is read, so that the render can be validated once the template
+	// has been executed.
+	watch bool
+
+	// cache, if set, is consulted before reading keys from redis. Values read from redis are stored in it if nothing
+	// has been invalidated since the render started.
+	cache      *Cache
+	generation uint64
+	result     renderResult
+
+	metrics  *Metrics
+	redacted *redactedValues
+}
+
+// renderResult describes a render: how the cache was used, and the files the template wrote.
+type renderResult struct {
+	cacheHits   int
+	cacheMisses int
+	files       []renderedFile
+
+	// secrets are the decrypted values read by secret. The outputs of renders that read secrets are only readable by
+	// their owner.
+	secrets []string
+}
+
+// outputMode returns the mode that the files written by the render are created with.
+func (r renderResult) outputMode() os.FileMode {
+	if len(r.secrets) > 0 {
+		return secretFileMode
+	}
+
+	return 0666
+}
+
+// renderOptions are the parts of the runtime configuration that affect rendering.
+type renderOptions struct {
+	cache    *Cache
+	metrics  *Metrics
+	redactor *Redactor
+
+	// overlay are values that are read instead of the values of the keys in redis. Renders with an overlay don't use
+	// the cache.
+	overlay map[string]Value
+}
+
+// renderOptions returns the parts of the configuration that affect rendering.
+func (cfg Config) renderOptions() renderOptions {
+	return renderOptions{
+		cache:    cfg.Cache,
+		metrics:  cfg.Metrics,
+		redactor: cfg.Redactor,
+	}
+}
+
+// funcMap returns the template functions bound to the render.
+func (r *render) funcMap() template.FuncMap {
+	return template.FuncMap{
+		"keyOrDefault": r.keyOrDefault,
+		"key":          r.key,
+		"fileContents": r.fileContents,
+		"include":      r.fileContents,
+		"ls":           r.ls,
+		"hash":         r.hash,
+		"secret":       r.secret,
+		"writeFile":    r.writeFile,
+	}
+}
+
+// prefetch reads all of the given keys in a single round trip, so that the template doesn't need to read them one at
+// a time. Keys that are cached aren't read.
+func (r *render) prefetch(keys []string) error {
+	r.values = make(map[string]*string, len(keys))
+
+	var uncached []string
+	for _, key := range keys {
+		if value, ok := r.cached(key); ok {
+			r.values[key] = value
+			continue
+		}
+
+		uncached = append(uncached, key)
+	}
+
+	if len(uncached) == 0 {
+		return nil
+	}
+
+	args := redis.Args{}.AddFlat(uncached)
+	if r.watch {
+		if _, err := r.do("WATCH", args...); err != nil {
+			return errors.Wrap(err, "failed to watch keys")
+		}
+	}
+
+	replies, err := redis.Values(r.do("MGET", args...))
+	if err != nil {
+		return errors.Wrap(err, "failed to prefetch keys")
+	}
+
+	for i, reply := range replies {
+		var value *string
+		if reply != nil {
+			v, err := redis.String(reply, nil)
+			if err != nil {
+				return errors.Wrapf(err, "failed to prefetch key %s", uncached[i])
+			}
+
+			value = &v
+		}
+
+		r.values[uncached[i]] = value
+		r.store(uncached[i], value)
+	}
+
+	return nil
+}
+
+// do runs the redis command on the render's connection, recording its latency.
+func (r *render) do(command string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := r.conn.Do(command, args...)
+	r.metrics.redisCommand(command, time.Since(start))
+	return reply, err
+}
+
+// cached returns the value of the key from the cache, counting the hit or miss.
+func (r *render) cached(key string) (*string, bool) {
+	if r.cache == nil {
+		return nil, false
+	}
+
+	value, ok := r.cache.get(key)
+	if ok {
+		r.result.cacheHits++
+	} else {
+		r.result.cacheMisses++
+	}
+
+	return value, ok
+}
+
+// store caches the value of a key read from redis.
+func (r *render) store(key string, value *string) {
+	if r.cache != nil {
+		r.cache.store(key, value, r.generation)
+	}
+}
+
+// get reads the given key from redis. If the key doesn't exist ok is false.
+func (r *render) get(key string) (value string, ok bool, err error) {
+	if !contains(r.read, key) {
+		r.read = append(r.read, key)
+	}
+
+	if overlay, ok := r.overlay[key]; ok {
+		if overlay.Type != TypeString {
+			return "", false, errors.Errorf("key %s is a %s, not a string", key, overlay.Type)
+		}
+
+		r.redacted.add(overlay.String)
+		return overlay.String, true, nil
+	}
+
+	prefetched, ok := r.values[key]
+	if !ok {
+		prefetched, ok = r.cached(key)
+	}
+
+	if ok {
+		if prefetched == nil {
+			return "", false, nil
+		}
+
+		r.redacted.add(*prefetched)
+		return *prefetched, true, nil
+	}
+
+	if r.watch {
+		if _, err := r.do("WATCH", key); err != nil {
+			return "", false, errors.Wrapf(err, "failed to watch key %s", key)
+		}
+	}
+
+	value, err = redis.String(r.do("GET", key))
+	if err == redis.ErrNil {
+		r.store(key, nil)
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to get key %s", key)
+	}
+
+	r.store(key, &value)
+	r.redacted.add(value)
+	return value, true, nil
+}
+
+// lookup reads the key under each of the key prefixes in turn, returning the value under the first prefix it exists
+// under. Every layer read until then is recorded as read, so that a layer gaining the key is noticed.
+func (r *render) lookup(key string) (string, bool, error) {
+	_, value, ok, err := r.resolve(key)
+	return value, ok, err
+}
+
+// resolve looks the key up as lookup does, also returning the name of the key it exists as under its prefix.
+func (r *render) resolve(key string) (string, string, bool, error) {
+	for _, layer := range layerKeys(r.prefixes, key) {
+		value, ok, err := r.get(layer)
+		if err != nil || ok {
+			return layer, value, ok, err
+		}
+	}
+
+	return "", "", false, nil
+}
+
+// key is the key template function. It returns the value of the key. Missing keys are rendered as empty strings, and
+// if the render is strict they are recorded so that the render can be failed once the template has been executed.
+func (r *render) key(argument interface{}) (interface{}, error) {
+	key, ok := argument.(string)
+	if !ok {
+		return nil, errors.New("invalid argument given to key")
+	}
+
+	value, ok, err := r.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok && r.strict && !contains(r.missing, key) {
+		r.missing = append(r.missing, key)
+	}
+
+	return value, nil
+}
+
+// keyOrDefault is the keyOrDefault template function. It returns the value of the key, or the default value if the
+// key doesn't exist.
+func (r *render) keyOrDefault(keyInterface interface{}, defaultValue interface{}) (interface{}, error) {
+	key, ok := keyInterface.(string)
+	if !ok {
+		return nil, errors.New("invalid argument given to key")
+	}
+
+	value, ok, err := r.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return defaultValue, nil
+	}
+
+	return value, nil
+}
+
+// secret is the secret template function. It returns the decrypted value of a key encrypted with SecretKey.Encrypt.
+// The value is redacted from the logs. Missing keys are handled as they are by key.
+func (r *render) secret(key string) (string, error) {
+	name, envelope, ok, err := r.resolve(key)
+	if err != nil {
+		return "", err
+	}
+
+	if !ok {
+		if r.strict && !contains(r.missing, key) {
+			r.missing = append(r.missing, key)
+		}
+
+		return "", nil
+	}
+
+	// the envelope is bound to the key it was encrypted for, including its prefix.
+	value, err := r.secretKey.Decrypt(name, envelope)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decrypt secret %s", key)
+	}
+
+	r.redacted.addSecret(value)
+	if !contains(r.result.secrets, value) {
+		r.result.secrets = append(r.result.secrets, value)
+	}
+
+	return value, nil
+}
+
+// fileContents is the fileContents template function, also available as include. It returns the raw contents of the
+// file, without executing it as a template.
+func (r *render) fileContents(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if !contains(r.included, path) {
+		r.included = append(r.included, path)
+	}
+
+	return string(contents), nil
+}
+
+// scanCount is the number of keys asked for by each SCAN.
+const scanCount = 100
+
+// ls is the ls template function. It returns the names of the keys starting with the prefix, with the prefix removed,
+// in sorted order. The names under every key prefix are merged.
+func (r *render) ls(prefix string) ([]string, error) {
+	names := map[string]bool{}
+	for _, layer := range layerKeys(r.prefixes, prefix) {
+		keys, err := scanKeys(r.do, layer)
+		if err != nil {
+			return nil, err
+		}
+
+		for key := range r.overlay {
+			if strings.HasPrefix(key, layer) {
+				keys = append(keys, key)
+			}
+		}
+
+		for _, key := range keys {
+			names[strings.TrimPrefix(key, layer)] = true
+		}
+	}
+
+	return sortedKeys(names), nil
+}
+
+// globEscaper escapes the characters that are special in redis glob patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// escapeGlob escapes the string so that it only matches itself in a redis glob pattern.
+func escapeGlob(s string) string {
+	return globEscaper.Replace(s)
+}
+
+// hash is the hash template function. It returns the fields of the hash stored at the key under the first key prefix
+// it exists under, which are empty if the key doesn't exist.
+func (r *render) hash(key string) (map[string]string, error) {
+	fields := map[string]string{}
+	for _, layer := range layerKeys(r.prefixes, key) {
+		var err error
+		if fields, err = r.readHash(layer); err != nil || len(fields) > 0 {
+			return fields, err
+		}
+	}
+
+	return fields, nil
+}
+
+// readHash returns the fields of the hash stored at the key, which are empty if the key doesn't exist.
+func (r *render) readHash(key string) (map[string]string, error) {
+	if overlay, ok := r.overlay[key]; ok {
+		if overlay.Type != TypeHash {
+			return nil, errors.Errorf("key %s is a %s, not a hash", key, overlay.Type)
+		}
+
+		fields := make(map[string]string, len(overlay.Fields))
+		for field, value := range overlay.Fields {
+			fields[field] = value
+			r.redacted.add(value)
+		}
+
+		return fields, nil
+	}
+
+	if r.watch {
+		if _, err := r.do("WATCH", key); err != nil {
+			return nil, errors.Wrapf(err, "failed to watch key %s", key)
+		}
+	}
+
+	fields, err := redis.StringMap(r.do("HGETALL", key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get hash %s", key)
+	}
+
+	for _, value := range fields {
+		r.redacted.add(value)
+	}
+
+	return fields, nil
+}
+
+// writeFile is the writeFile template function. It writes the contents to the named file in the template's
+// destination directory, in addition to the template's own output. It renders nothing.
+func (r *render) writeFile(name string, contents interface{}) (string, error) {
+	if err := validOutputName(name); err != nil {
+		return "", err
+	}
+
+	for _, file := range r.files {
+		if file.name == filepath.Clean(name) {
+			return "", errors.Errorf("file %s written more than once", name)
+		}
+	}
+
+	r.files = append(r.files, renderedFile{name: filepath.Clean(name), contents: fmt.Sprint(contents)})
+	return "", nil
+}
+
+// contains reports whether the value is in the slice.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Render executes the template, writing the output to the given writer. If the template is strict and reads keys that
+// don't exist a *MissingKeysError is returned. If the template is consistent the render is retried until every key it
+// read is unchanged by the end of the render.
+//
+// A single pooled connection is used for the whole render, and the keys read by the previous render are prefetched
+// with one MGET.
+func (t Template) Render(w io.Writer) error {
+	_, err := t.renderWith(w, renderOptions{})
+	return err
+}
+
+// renderWith renders the template using the given options.
+func (t Template) renderWith(w io.Writer, opts renderOptions) (renderResult, error) {
+	c := t.pool.Get()
+	defer c.Close()
+
+	// the values read by the template's last render are no longer redacted, only those read by this render are.
+	values := opts.redactor.begin(t.SourceTemplate.Name())
+
+	if !t.Consistent {
+		r := &render{
+			conn:      c,
+			strict:    t.strict(),
+			prefixes:  t.KeyPrefixes,
+			secretKey: t.SecretKey,
+			metrics:   opts.metrics,
+			redacted:  values,
+			overlay:   opts.overlay,
+		}
+
+		// the render reads through the cache's tracked connection for its reads to be invalidated. If the cache isn't
+		// available the render reads directly from redis.
+		if opts.overlay == nil {
+			if conn, generation, release, ok := opts.cache.acquire(); ok {
+				defer release()
+				r.conn = conn
+				r.cache = opts.cache
+				r.generation = generation
+			}
+		}
+
+		err := t.render(w, r)
+		r.result.files = r.files
+		return r.result, err
+	}
+
+	// consistent renders don't use the cache, as every key they read needs to be watched.
+	for i := 0; i < maxConsistentRenderAttempts; i++ {
+		buffer := bytes.NewBuffer(nil)
+		r := &render{
+			conn:      c,
+			strict:    t.strict(),
+			prefixes:  t.KeyPrefixes,
+			secretKey: t.SecretKey,
+			watch:     true,
+			metrics:   opts.metrics,
+			redacted:  values,
+			overlay:   opts.overlay,
+		}
+
+		if err := t.render(buffer, r); err != nil {
+			c.Do("UNWATCH")
+			return renderResult{}, err
+		}
+
+		// an empty transaction only succeeds if none of the watched keys have been modified since they were read.
+		if _, err := c.Do("MULTI"); err != nil {
+			return renderResult{}, errors.WithStack(err)
+		}
+
+		reply, err := c.Do("EXEC")
+		if err != nil {
+			return renderResult{}, errors.WithStack(err)
+		}
+
+		if reply != nil {
+			_, err := w.Write(buffer.Bytes())
+			return renderResult{files: r.files, secrets: r.result.secrets}, errors.WithStack(err)
+		}
+	}
+
+	return renderResult{}, errors.Wrap(ErrInconsistentRender, t.SourceTemplate.Name())
+}
+
+// strict reports whether the render fails on missing keys. A strict template that gave up waiting for its missing keys
+// with the fallback renders them empty.
+func (t Template) strict() bool {
+	return t.Strict && !t.state.isLenient()
+}
+
+// render executes the template with its functions bound to the given render.
+func (t Template) render(w io.Writer, r *render) error {
+	if err := r.prefetch(t.state.getDependencies()); err != nil {
+		return err
+	}
+
+	// the template is cloned so that the functions can be bound to this render without affecting concurrent renders.
+	tmpl, err := t.SourceTemplate.Clone()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = tmpl.Funcs(r.funcMap()).Execute(w, nil)
+	t.state.setDependencies(r.read)
+	t.state.setIncluded(r.included)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if len(r.missing) > 0 {
+		return &MissingKeysError{
+			Template: t.SourceTemplate.Name(),
+			Keys:     r.missing,
+		}
+	}
+
+	return nil
+}
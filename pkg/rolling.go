@@ -0,0 +1,378 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RolloutPrefix is the prefix of the keys coordinating rolling reloads. It is followed by the name of the rollout.
+const RolloutPrefix = "redis-template:rollout:"
+
+// defaultLeaseTTL is how long a lease lasts when the rolling config doesn't give a lease_ttl.
+const defaultLeaseTTL = time.Minute
+
+// minLeaseTTL is the shortest lease_ttl allowed. The lease is renewed at a third of it, which must leave time for the
+// renewals to reach redis.
+const minLeaseTTL = time.Second
+
+// failuresTTL is how long the failures of a generation are counted after the last one, so that the counters of old
+// generations don't pile up.
+const failuresTTL = 24 * time.Hour
+
+// ErrRolloutHalted is returned when a rollout has been halted because too many nodes failed. It is resumed with
+// ResetRollout.
+var ErrRolloutHalted = errors.New("the rollout was halted after too many failures")
+
+// errLeaseUnavailable is returned when every lease of a rollout is held. The template is retried until it gets one.
+var errLeaseUnavailable = errors.New("every lease of the rollout is held")
+
+// Duration is a time.Duration given in the config file as a string, e.g. "30s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Errorf("invalid duration %s, expected a string such as \"30s\"", data)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RollingConfig configures a template's command to be run as a rolling reload across every node rendering the
+// template. A node must hold one of MaxConcurrent leases to write the template's outputs and run its command, so that
+// only that many nodes reload at once. The lease is released once the command, and the health check, succeed. If
+// MaxFailures nodes fail the rollout is halted, and no more nodes reload until it is reset.
+type RollingConfig struct {
+	// Name is the name of the rollout, shared by the nodes rendering the template. It defaults to the template's source.
+	Name string `json:"name"`
+
+	// MaxConcurrent is the number of nodes that can reload at once. Rolling reloads are disabled when it is zero.
+	MaxConcurrent int `json:"max_concurrent"`
+
+	// LeaseTTL is how long a lease lasts if the node holding it stops renewing it, e.g. because it died. It defaults to
+	// a minute.
+	LeaseTTL Duration `json:"lease_ttl"`
+
+	// HealthCmd, if set, is run after the command succeeds. The node's reload only succeeds if it exits with zero.
+	HealthCmd string `json:"health_cmd"`
+
+	// MaxFailures is the number of failed reloads that halts the rollout. Zero never halts it.
+	MaxFailures int `json:"max_failures"`
+}
+
+// enabled reports whether the template's command is run as a rolling reload.
+func (c RollingConfig) enabled() bool {
+	return c.MaxConcurrent > 0
+}
+
+// validate returns an error if the rolling config is invalid.
+func (c RollingConfig) validate() error {
+	if c.LeaseTTL != 0 && time.Duration(c.LeaseTTL) < minLeaseTTL {
+		return errors.Errorf("invalid lease_ttl %s, expected at least %s", time.Duration(c.LeaseTTL), minLeaseTTL)
+	}
+
+	return nil
+}
+
+// leaseTTL returns the lease ttl, falling back to defaultLeaseTTL.
+func (c RollingConfig) leaseTTL() time.Duration {
+	if c.LeaseTTL <= 0 {
+		return defaultLeaseTTL
+	}
+
+	return time.Duration(c.LeaseTTL)
+}
+
+// rolloutKeys are the keys coordinating a rollout: a sorted set of the nodes holding leases scored by when their
+// leases expire, the prefix of the keys counting the failures of each generation, and whether the rollout is halted.
+type rolloutKeys struct {
+	holders  string
+	failures string
+	halted   string
+}
+
+// keysOf returns the keys of the named rollout.
+func keysOf(name string) rolloutKeys {
+	return rolloutKeys{
+		holders:  RolloutPrefix + name + ":holders",
+		failures: RolloutPrefix + name + ":failures:",
+		halted:   RolloutPrefix + name + ":halted",
+	}
+}
+
+// failuresOf returns the key counting the failed reloads of the generation, so that failures of earlier changes don't
+// count towards halting the rollout of a later one.
+func (k rolloutKeys) failuresOf(generation int64) string {
+	return k.failures + strconv.FormatInt(generation, 10)
+}
+
+// serverTime sets now to the time of the redis server in milliseconds, so that the nodes agree on when leases expire
+// whatever their clocks say.
+const serverTime = `
+if redis.replicate_commands then redis.replicate_commands() end
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+
+// acquireScript takes a lease for ARGV[1] if fewer than ARGV[2] nodes hold unexpired leases, or renews it if it already
+// holds one, returning 1. It returns 0 if every lease is held, and -1 if the rollout is halted.
+var acquireScript = redis.NewScript(2, serverTime+`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return -1
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) or redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	return 1
+end
+
+return 0
+`)
+
+// renewScript extends the lease held by ARGV[1], returning 0 if it no longer holds one.
+var renewScript = redis.NewScript(1, serverTime+`
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// releaseScript releases the lease held by ARGV[1]. If its reload failed the failure is counted for ARGV[4]
+// milliseconds, halting the rollout once there are ARGV[3] failures, when it returns -1.
+var releaseScript = redis.NewScript(3, `
+redis.call('ZREM', KEYS[1], ARGV[1])
+if ARGV[2] ~= '1' then
+	return 1
+end
+
+local failures = redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+if tonumber(ARGV[3]) > 0 and failures >= tonumber(ARGV[3]) then
+	redis.call('SET', KEYS[3], failures)
+	return -1
+end
+
+return 1
+`)
+
+// rolloutHolder identifies this process as the holder of a lease.
+var rolloutHolder = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}()
+
+// rollout is a node's part in the rolling reload of a template.
+type rollout struct {
+	pool   *redis.Pool
+	name   string
+	holder string
+	config RollingConfig
+	keys   rolloutKeys
+}
+
+// newRollout returns the rollout of the template.
+func newRollout(template Template) rollout {
+	name := template.flag.Rolling.Name
+	if name == "" {
+		name = template.SourceTemplate.Name()
+	}
+
+	return rollout{pool: template.pool, name: name, holder: rolloutHolder, config: template.flag.Rolling, keys: keysOf(name)}
+}
+
+// eval runs the script, returning its integer result.
+func (r rollout) eval(script *redis.Script, args ...interface{}) (int, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	return redis.Int(script.Do(c, args...))
+}
+
+// acquire takes a lease. It returns errLeaseUnavailable if every lease is held, and ErrRolloutHalted if the rollout is
+// halted. It doesn't wait for a lease, so that the listener carries on handling messages while the template waits.
+func (r rollout) acquire() error {
+	ttl := int64(r.config.leaseTTL() / time.Millisecond)
+	acquired, err := r.eval(acquireScript, r.keys.holders, r.keys.halted, r.holder, r.config.MaxConcurrent, ttl)
+	if err != nil {
+		return errors.Wrapf(err, "failed to acquire a lease of rollout %s", r.name)
+	}
+
+	switch acquired {
+	case 1:
+		return nil
+	case -1:
+		return errors.Wrap(ErrRolloutHalted, r.name)
+	}
+
+	return errors.Wrap(errLeaseUnavailable, r.name)
+}
+
+// renew extends the lease until done is closed, so that a slow command doesn't lose it.
+func (r rollout) renew(logger *log.Entry, done chan struct{}) {
+	ttl := int64(r.config.leaseTTL() / time.Millisecond)
+	ticker := time.NewTicker(r.config.leaseTTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			renewed, err := r.eval(renewScript, r.keys.holders, r.holder, ttl)
+			if err != nil {
+				logger.WithError(err).WithField("rollout", r.name).Warn("failed to renew the lease")
+			} else if renewed == 0 {
+				logger.WithField("rollout", r.name).Warn("the lease expired while reloading")
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// release releases the lease, counting the reload as a failure of the generation if it failed. It reports whether the
+// failure halted the rollout.
+func (r rollout) release(failed bool, generation int64) (bool, error) {
+	flag := 0
+	if failed {
+		flag = 1
+	}
+
+	released, err := r.eval(releaseScript, r.keys.holders, r.keys.failuresOf(generation), r.keys.halted, r.holder, flag,
+		r.config.MaxFailures, int64(failuresTTL/time.Millisecond))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to release the lease of rollout %s", r.name)
+	}
+
+	return released == -1, nil
+}
+
+// run runs the reload while holding a lease of the rollout, followed by the health check. The lease is released once
+// they complete, counting a failure of the generation being rolled out if either failed.
+func (r rollout) run(logger *log.Entry, reload func() error) error {
+	c := r.pool.Get()
+	generation, err := getGeneration(c)
+	c.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := r.acquire(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go r.renew(logger, done)
+
+	err = reload()
+	if err == nil && r.config.HealthCmd != "" {
+		cmd := exec.Command("sh", "-c", r.config.HealthCmd)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if healthErr := cmd.Run(); healthErr != nil {
+			err = errors.Wrap(healthErr, "health check failed")
+		}
+	}
+
+	close(done)
+
+	halted, releaseErr := r.release(err != nil, generation)
+	if releaseErr != nil {
+		logger.WithError(releaseErr).Warn("failed to release the lease")
+	}
+
+	if halted {
+		logger.WithField("rollout", r.name).Error("halted the rollout after too many failures")
+	}
+
+	return err
+}
+
+// RolloutStatus is the state of a rollout.
+type RolloutStatus struct {
+	Name string `json:"name"`
+
+	// Holders are the nodes holding unexpired leases.
+	Holders []string `json:"holders"`
+
+	// Failures are the failed reloads of the current generation.
+	Failures int  `json:"failures"`
+	Halted   bool `json:"halted"`
+}
+
+// GetRollout returns the state of the named rollout.
+func GetRollout(p *redis.Pool, name string) (RolloutStatus, error) {
+	c := p.Get()
+	defer c.Close()
+
+	keys := keysOf(name)
+	status := RolloutStatus{Name: name}
+
+	now, err := redis.Int64s(c.Do("TIME"))
+	if err != nil || len(now) != 2 {
+		return RolloutStatus{}, errors.Wrap(err, "failed to get the time")
+	}
+
+	ms := now[0]*1000 + now[1]/1000
+	if status.Holders, err = redis.Strings(c.Do("ZRANGEBYSCORE", keys.holders, "("+strconv.FormatInt(ms, 10), "+inf")); err != nil {
+		return RolloutStatus{}, errors.Wrapf(err, "failed to get the holders of rollout %s", name)
+	}
+
+	generation, err := getGeneration(c)
+	if err != nil {
+		return RolloutStatus{}, err
+	}
+
+	if status.Failures, err = redis.Int(c.Do("GET", keys.failuresOf(generation))); err != nil && err != redis.ErrNil {
+		return RolloutStatus{}, errors.Wrapf(err, "failed to get the failures of rollout %s", name)
+	}
+
+	if status.Halted, err = redis.Bool(c.Do("EXISTS", keys.halted)); err != nil {
+		return RolloutStatus{}, errors.Wrapf(err, "failed to get whether rollout %s is halted", name)
+	}
+
+	return status, nil
+}
+
+// ResetRollout clears the failures of the current generation of the named rollout, resuming it if it was halted. Nodes
+// that skipped their reload while it was halted reload on their next update.
+func ResetRollout(p *redis.Pool, name string) error {
+	c := p.Get()
+	defer c.Close()
+
+	generation, err := getGeneration(c)
+	if err != nil {
+		return err
+	}
+
+	keys := keysOf(name)
+	_, err = c.Do("DEL", keys.failuresOf(generation), keys.halted)
+	return errors.Wrapf(err, "failed to reset rollout %s", name)
+}
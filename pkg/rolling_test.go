@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuration_JSON(t *testing.T) {
+	var d Duration
+	if err := json.Unmarshal([]byte(`"1m30s"`), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Duration(90*time.Second), d)
+
+	encoded, err := json.Marshal(d)
+	assert.NoError(t, err)
+	assert.Equal(t, `"1m30s"`, string(encoded))
+
+	assert.Error(t, json.Unmarshal([]byte(`90`), &d))
+	assert.Error(t, json.Unmarshal([]byte(`"soon"`), &d))
+}
+
+func TestLoadFileConfig_Rolling(t *testing.T) {
+	const TestConfig = "./test_files/rolling.json"
+
+	err := ioutil.WriteFile(TestConfig, []byte(`{
+	"templates": [{
+		"source": "/etc/nginx/nginx.conf.tmpl",
+		"destination": "/etc/nginx/nginx.conf",
+		"command": "nginx -s reload",
+		"rolling": {
+			"max_concurrent": 2,
+			"lease_ttl": "30s",
+			"health_cmd": "curl -f localhost/healthz",
+			"max_failures": 3
+		}
+	}]
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadFileConfig(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rolling := cfg.Templates[0].Rolling
+	assert.Equal(t, RollingConfig{
+		MaxConcurrent: 2,
+		LeaseTTL:      Duration(30 * time.Second),
+		HealthCmd:     "curl -f localhost/healthz",
+		MaxFailures:   3,
+	}, rolling)
+	assert.True(t, rolling.enabled())
+	assert.Equal(t, 30*time.Second, rolling.leaseTTL())
+
+	assert.False(t, RollingConfig{}.enabled())
+	assert.Equal(t, defaultLeaseTTL, RollingConfig{}.leaseTTL())
+
+	assert.NoError(t, rolling.validate())
+	assert.NoError(t, RollingConfig{}.validate())
+	assert.Error(t, RollingConfig{LeaseTTL: Duration(time.Millisecond)}.validate())
+}
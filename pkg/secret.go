@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretEnvelopePrefix is the prefix of the values encrypted by SecretKey.Encrypt. It is followed by the base64 encoded
+// nonce and ciphertext.
+const SecretEnvelopePrefix = "enc:aes-256-gcm:"
+
+// SecretKeyEnv is the environment variable the secret key is read from when no key file is given.
+const SecretKeyEnv = "REDIS_TEMPLATE_SECRET_KEY"
+
+// secretKeySize is the size of an AES-256 key.
+const secretKeySize = 32
+
+// SecretKey encrypts and decrypts the values of secret keys with AES-256-GCM, so that secrets aren't stored in redis
+// as plaintext. The key is only given to the nodes that render the secrets.
+type SecretKey struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+// GenerateSecretKey returns a new random key, base64 encoded as ParseSecretKey expects.
+func GenerateSecretKey() (string, error) {
+	key := make([]byte, secretKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseSecretKey parses a base64 encoded 32 byte key.
+func ParseSecretKey(encoded string) (*SecretKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.New("invalid secret key, expected 32 base64 encoded bytes")
+	}
+
+	if len(key) != secretKeySize {
+		return nil, errors.Errorf("invalid secret key, expected 32 bytes but got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &SecretKey{key: key, aead: aead}, nil
+}
+
+// LoadSecretKey reads the secret key from the file at the path, or from SecretKeyEnv if the path is empty. It returns
+// nil if neither is given.
+func LoadSecretKey(path string) (*SecretKey, error) {
+	if path == "" {
+		encoded := os.Getenv(SecretKeyEnv)
+		if encoded == "" {
+			return nil, nil
+		}
+
+		key, err := ParseSecretKey(encoded)
+		return key, errors.Wrapf(err, "invalid %s", SecretKeyEnv)
+	}
+
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	key, err := ParseSecretKey(string(encoded))
+	return key, errors.Wrapf(err, "invalid key file %s", path)
+}
+
+// Encrypt encrypts the plaintext to be stored as the named key, returning an envelope that Decrypt accepts. The
+// envelope is bound to the name, so that it can't be decrypted as the value of another key.
+func (k *SecretKey) Encrypt(name string, plaintext string) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	sealed := k.aead.Seal(nonce, nonce, []byte(plaintext), []byte(name))
+	return SecretEnvelopePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts an envelope returned by Encrypt for the named key. The errors never include the plaintext. A nil
+// *SecretKey can't decrypt anything.
+func (k *SecretKey) Decrypt(name string, envelope string) (string, error) {
+	if k == nil {
+		return "", errors.Errorf("no secret key, give one with -secret-key-file or %s", SecretKeyEnv)
+	}
+
+	if !strings.HasPrefix(envelope, SecretEnvelopePrefix) {
+		return "", errors.Errorf("not encrypted, expected a value starting with %s", SecretEnvelopePrefix)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(envelope, SecretEnvelopePrefix))
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", errors.New("failed to decrypt the secret, it was encrypted with another key, for another key " +
+			"name, or has been modified")
+	}
+
+	return string(plaintext), nil
+}
+
+// equal reports whether the two keys are the same key. Two nil keys are equal.
+func (k *SecretKey) equal(other *SecretKey) bool {
+	if k == nil || other == nil {
+		return k == other
+	}
+
+	return subtle.ConstantTimeCompare(k.key, other.key) == 1
+}
+
+// secretFileMode is the mode of the files written by renders that read secrets.
+const secretFileMode = 0600
+
+// redactSecrets replaces every secret in the text, so that output containing them can be shown.
+func redactSecrets(text string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			text = strings.Replace(text, secret, redacted, -1)
+		}
+	}
+
+	return text
+}
@@ -0,0 +1,225 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSecretKey returns a new random secret key.
+func testSecretKey(t *testing.T) *SecretKey {
+	encoded, err := GenerateSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseSecretKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestSecretKey_EncryptDecrypt(t *testing.T) {
+	key := testSecretKey(t)
+
+	envelope, err := key.Encrypt("db:password", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasPrefix(envelope, SecretEnvelopePrefix))
+	assert.NotContains(t, envelope, "hunter2")
+
+	value, err := key.Decrypt("db:password", envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	// every encryption uses a new nonce.
+	again, err := key.Encrypt("db:password", "hunter2")
+	assert.NoError(t, err)
+	assert.NotEqual(t, envelope, again)
+
+	_, err = testSecretKey(t).Decrypt("db:password", envelope)
+	assert.Error(t, err)
+
+	_, err = key.Decrypt("db:password", envelope[:len(envelope)-4]+"AAAA")
+	assert.Error(t, err)
+
+	_, err = key.Decrypt("db:password", "hunter2")
+	assert.Error(t, err)
+
+	// the envelope can't be moved to another key.
+	_, err = key.Decrypt("app:debug_password", envelope)
+	assert.Error(t, err)
+
+	var missing *SecretKey
+	_, err = missing.Decrypt("db:password", envelope)
+	assert.Error(t, err)
+}
+
+func TestParseSecretKey(t *testing.T) {
+	_, err := ParseSecretKey("not base64!")
+	assert.Error(t, err)
+
+	_, err = ParseSecretKey("c2hvcnQ=")
+	assert.EqualError(t, err, "invalid secret key, expected 32 bytes but got 5")
+}
+
+func TestLoadSecretKey(t *testing.T) {
+	encoded, err := GenerateSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const TestKeyFile = "./test_files/secret.key"
+	if err := ioutil.WriteFile(TestKeyFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fromFile, err := LoadSecretKey(TestKeyFile)
+	assert.NoError(t, err)
+
+	os.Setenv(SecretKeyEnv, encoded)
+	defer os.Unsetenv(SecretKeyEnv)
+
+	fromEnv, err := LoadSecretKey("")
+	assert.NoError(t, err)
+	assert.True(t, fromFile.equal(fromEnv))
+
+	os.Unsetenv(SecretKeyEnv)
+	none, err := LoadSecretKey("")
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+}
+
+func TestTemplate_RenderSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "db.tmpl")
+	if err := ioutil.WriteFile(source, []byte(`password {{ secret "db:password" }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	key := testSecretKey(t)
+	envelope, err := key.Encrypt("db:password", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every key is overlaid, so redis is never read.
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("redis is unavailable") }}
+	target := filepath.Join(dir, "db.conf")
+	template, err := TemplateFlag{Source: source, Target: target}.ToTemplate(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SecretKey = key
+	redactor := NewRedactor()
+	overlay := map[string]Value{"db:password": *StringValue(envelope)}
+
+	buffer := bytes.NewBuffer(nil)
+	result, err := template.renderWith(buffer, renderOptions{redactor: redactor, overlay: overlay})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "password hunter2", buffer.String())
+	assert.Equal(t, []string{"hunter2"}, result.secrets)
+	assert.Equal(t, "password [REDACTED]", redactor.redactString("password hunter2"))
+
+	// an existing file is restricted before the secret is written to it.
+	if err := ioutil.WriteFile(target, []byte("password old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := template.writeOutputs(buffer.Bytes(), result, RedisTemplateChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// secrets aren't written to other sinks unless the template allows them.
+	stdout := bytes.NewBuffer(nil)
+	template.Sink = &WriterSink{Writer: stdout}
+	err = template.writeOutputs(buffer.Bytes(), result, RedisTemplateChannel)
+	assert.EqualError(t, err, "template "+source+" read secrets, which are only written to files unless it allows secrets")
+	assert.Empty(t, stdout.String())
+
+	template.AllowSecrets = true
+	assert.NoError(t, template.writeOutputs(buffer.Bytes(), result, RedisTemplateChannel))
+	assert.Equal(t, "password hunter2", stdout.String())
+
+	// a new template is diffed, as the template would prefetch the keys it read from redis.
+	template, err = TemplateFlag{Source: source, Target: target}.ToTemplate(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SecretKey = key
+	diffs, err := template.Diff(overlay)
+	assert.NoError(t, err)
+	assert.Equal(t, []OutputDiff{
+		{Path: target, Exists: true, Current: "password [REDACTED]", Rendered: "password [REDACTED]"},
+	}, diffs)
+
+	template, err = TemplateFlag{Source: source, Target: target}.ToTemplate(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = template.Diff(overlay)
+	assert.Error(t, err, "secrets can't be rendered without the key")
+
+	// a secret read under a key prefix is decrypted as the key it is stored as.
+	prefixed, err := key.Encrypt("env:prod:db:password", "hunter3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template, err = TemplateFlag{Source: source, Target: target}.ToTemplate(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SecretKey = key
+	template.KeyPrefixes = []string{"env:prod:"}
+
+	buffer.Reset()
+	_, err = template.renderWith(buffer, renderOptions{overlay: map[string]Value{"env:prod:db:password": *StringValue(prefixed)}})
+	assert.NoError(t, err)
+	assert.Equal(t, "password hunter3", buffer.String())
+
+	// a new template is rendered, as the template would prefetch the keys it read from redis.
+	template, err = TemplateFlag{Source: source, Target: target}.ToTemplate(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SecretKey = key
+	template.KeyPrefixes = []string{"env:prod:"}
+
+	_, err = template.renderWith(buffer, renderOptions{overlay: map[string]Value{"env:prod:db:password": *StringValue(envelope)}})
+	if assert.Error(t, err, "the envelope was encrypted for another key") {
+		assert.Contains(t, err.Error(), "for another key name")
+	}
+}
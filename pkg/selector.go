@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NodeLabel is the label of a selector that matches the name of the node, rather than one of its tags.
+const NodeLabel = "node"
+
+// Selector addresses a notification to the nodes that match all of its requirements, e.g. role=web,region=eu. An
+// empty selector addresses every node.
+type Selector []Requirement
+
+// Requirement matches the nodes whose tag, or name if the label is NodeLabel, is one of the values, e.g. role=web or
+// node=web-1|web-2.
+type Requirement struct {
+	Label  string
+	Values []string
+}
+
+// ParseSelector parses a selector given as comma separated requirements, each a label and one or more values separated
+// by |, e.g. role=web,region=eu or node=web-1|web-2.
+func ParseSelector(s string) (Selector, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	var selector Selector
+	for _, term := range strings.Split(s, ",") {
+		i := strings.Index(term, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid selector %q, expected label=value[,label=value]", s)
+		}
+
+		requirement := Requirement{Label: strings.TrimSpace(term[:i])}
+		for _, value := range strings.Split(term[i+1:], "|") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				return nil, errors.Errorf("invalid selector %q, label %s has an empty value", s, requirement.Label)
+			}
+
+			requirement.Values = append(requirement.Values, value)
+		}
+
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+// String returns the selector in the form parsed by ParseSelector.
+func (s Selector) String() string {
+	terms := make([]string, 0, len(s))
+	for _, requirement := range s {
+		terms = append(terms, requirement.Label+"="+strings.Join(requirement.Values, "|"))
+	}
+
+	return strings.Join(terms, ",")
+}
+
+// Matches reports whether the node with the name and tags is addressed by the selector.
+func (s Selector) Matches(node string, tags map[string]string) bool {
+	for _, requirement := range s {
+		value, ok := tags[requirement.Label]
+		if requirement.Label == NodeLabel {
+			value, ok = node, true
+		}
+
+		if !ok || !contains(requirement.Values, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addressedTo reports whether the payload of a message is addressed to the node with the name and tags. Payloads that
+// aren't notifications, such as ".", and notifications without a selector are addressed to every node.
+func addressedTo(payload []byte, node string, tags map[string]string) (bool, error) {
+	var n Notification
+	if err := json.Unmarshal(payload, &n); err != nil || n.Selector == "" {
+		return true, nil
+	}
+
+	selector, err := ParseSelector(n.Selector)
+	if err != nil {
+		return true, err
+	}
+
+	return selector.Matches(node, tags), nil
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("role=web, region=eu|us")
+	assert.NoError(t, err)
+	assert.Equal(t, Selector{
+		{Label: "role", Values: []string{"web"}},
+		{Label: "region", Values: []string{"eu", "us"}},
+	}, selector)
+	assert.Equal(t, "role=web,region=eu|us", selector.String())
+
+	selector, err = ParseSelector("")
+	assert.NoError(t, err)
+	assert.Nil(t, selector)
+
+	for _, invalid := range []string{"role", "=web", "role=", "role=web|", "role=web,"} {
+		_, err := ParseSelector(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSelector_Matches(t *testing.T) {
+	tags := map[string]string{"role": "web", "region": "eu"}
+
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"role=web", true},
+		{"role=web,region=eu", true},
+		{"role=web,region=us", false},
+		{"role=db|web", true},
+		{"zone=a", false},
+		{"node=web-3", true},
+		{"node=web-1|web-2", false},
+		{"node=web-3,role=db", false},
+	}
+
+	for _, test := range tests {
+		selector, err := ParseSelector(test.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, test.matches, selector.Matches("web-3", tags), test.selector)
+	}
+}
+
+func TestAddressedTo(t *testing.T) {
+	tags := map[string]string{"role": "web"}
+
+	tests := []struct {
+		payload   string
+		addressed bool
+		err       bool
+	}{
+		{".", true, false},
+		{`{"keys":["a"]}`, true, false},
+		{`{"keys":[],"selector":"role=web"}`, true, false},
+		{`{"keys":[],"selector":"role=db"}`, false, false},
+		{`{"keys":[],"selector":"role"}`, true, true},
+	}
+
+	for _, test := range tests {
+		addressed, err := addressedTo([]byte(test.payload), "web-3", tags)
+		assert.Equal(t, test.addressed, addressed, test.payload)
+		assert.Equal(t, test.err, err != nil, test.payload)
+	}
+}
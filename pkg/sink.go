@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Sink is a destination for the output of a template. Custom destinations can be used by setting the Sink of a
+// Template.
+type Sink interface {
+	// Write writes the output of the template. It is only called when the output has changed.
+	Write(output []byte) error
+}
+
+// ParseSink returns the sink for the destination of a template:
+//
+//	stdout or -                      the output is written to stdout.
+//	redis://key[?channel=name]       the output is set as the key, and a notification is published on the channel,
+//	                                 which defaults to the channel the listener subscribes to. An empty channel
+//	                                 publishes nothing.
+//	http://... or https://...        the output is POSTed to the url.
+//	anything else                    the output is written to the file at the path.
+//
+// An empty destination has no sink.
+func ParseSink(destination string, p *redis.Pool) (Sink, error) {
+	switch {
+	case destination == "":
+		return nil, nil
+	case destination == "stdout" || destination == "-":
+		return &WriterSink{Writer: os.Stdout}, nil
+	case strings.HasPrefix(destination, "redis://"):
+		return parseRedisSink(strings.TrimPrefix(destination, "redis://"), p)
+	case strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://"):
+		if _, err := url.Parse(destination); err != nil {
+			return nil, errors.Wrapf(err, "invalid destination %s", destination)
+		}
+
+		return &HTTPSink{URL: destination}, nil
+	default:
+		return &FileSink{Path: destination}, nil
+	}
+}
+
+// parseRedisSink parses the part of a redis destination after the scheme. The key isn't parsed as a url, as keys
+// commonly contain colons.
+func parseRedisSink(destination string, p *redis.Pool) (Sink, error) {
+	sink := &RedisSink{Pool: p, Key: destination, Channel: RedisTemplateChannel, listenerChannel: true}
+	if i := strings.IndexRune(destination, '?'); i != -1 {
+		query, err := url.ParseQuery(destination[i+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid destination redis://%s", destination)
+		}
+
+		sink.Key = destination[:i]
+		if _, ok := query["channel"]; ok {
+			sink.Channel = query.Get("channel")
+			sink.listenerChannel = false
+		}
+	}
+
+	if sink.Key == "" {
+		return nil, errors.New("redis destination has no key")
+	}
+
+	return sink, nil
+}
+
+// FileSink writes the output to a file.
+type FileSink struct {
+	Path string
+
+	// Mode, if set, is the mode the file is written with, which an existing file is changed to. It defaults to 0666
+	// before the umask.
+	Mode os.FileMode
+}
+
+// Write implements the Sink interface.
+func (s *FileSink) Write(output []byte) error {
+	mode := s.Mode
+	if mode == 0 {
+		mode = 0666
+	}
+
+	return writeOutputFile(s.Path, output, mode)
+}
+
+// WriterSink writes the output to a writer, such as stdout. Writes are serialized so that the outputs of templates
+// sharing the writer aren't interleaved.
+type WriterSink struct {
+	Writer io.Writer
+
+	mut sync.Mutex
+}
+
+// Write implements the Sink interface.
+func (s *WriterSink) Write(output []byte) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	_, err := s.Writer.Write(output)
+	return errors.WithStack(err)
+}
+
+// RedisSink sets the output as the value of a key, so that it can be consumed by other services. If Channel is set a
+// notification is published on it once the key is set, so that other instances of redis-template using the key are
+// updated.
+//
+// The key is derived rather than changed by an operator, so writes aren't counted in GenerationKey. When the channel is
+// the one the listener subscribes to, the listener is notified of its own write and renders its templates again. As
+// outputs are only written when they change this settles after a single render, unless the template reads the key it
+// writes, which writeOutputs refuses.
+type RedisSink struct {
+	Pool    *redis.Pool
+	Key     string
+	Channel string
+
+	// listenerChannel is set if the channel wasn't given with the destination, in which case the notification is
+	// published on the channel the listener subscribes to.
+	listenerChannel bool
+}
+
+// Write implements the Sink interface.
+func (s *RedisSink) Write(output []byte) error {
+	c := s.Pool.Get()
+	defer c.Close()
+
+	if s.Channel == "" {
+		_, err := c.Do("SET", s.Key, output)
+		return errors.Wrapf(err, "failed to set key %s", s.Key)
+	}
+
+	if err := c.Send("MULTI"); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := c.Send("SET", s.Key, output); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := c.Send("PUBLISH", s.Channel, notification([]string{s.Key}, nil)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err := c.Do("EXEC")
+	return errors.Wrapf(err, "failed to set key %s", s.Key)
+}
+
+// httpSinkTimeout is how long an HTTPSink waits for the endpoint to respond.
+const httpSinkTimeout = 10 * time.Second
+
+// HTTPSink POSTs the output to a url, such as the reload endpoint of a local admin api. Responses other than 2xx are
+// errors.
+type HTTPSink struct {
+	URL string
+
+	// Client is the client used to make the requests. If nil a client with a 10 second timeout is used.
+	Client *http.Client
+}
+
+// Write implements the Sink interface.
+func (s *HTTPSink) Write(output []byte) error {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: httpSinkTimeout}
+	}
+
+	resp, err := client.Post(s.URL, "text/plain; charset=utf-8", bytes.NewReader(output))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded with %s: %s", s.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSink(t *testing.T) {
+	sink, err := ParseSink("", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, sink)
+
+	sink, err = ParseSink("-", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &WriterSink{Writer: os.Stdout}, sink)
+
+	sink, err = ParseSink("/etc/app.conf", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &FileSink{Path: "/etc/app.conf"}, sink)
+
+	sink, err = ParseSink("http://localhost:8080/reload", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &HTTPSink{URL: "http://localhost:8080/reload"}, sink)
+
+	sink, err = ParseSink("redis://derived:app:config", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &RedisSink{Key: "derived:app:config", Channel: RedisTemplateChannel, listenerChannel: true}, sink)
+
+	sink, err = ParseSink("redis://derived:app:config?channel=", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &RedisSink{Key: "derived:app:config"}, sink)
+
+	_, err = ParseSink("redis://", nil)
+	assert.NotNil(t, err)
+}
+
+func TestWriterSink(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	sink := &WriterSink{Writer: buffer}
+
+	assert.Nil(t, sink.Write([]byte("a")))
+	assert.Nil(t, sink.Write([]byte("b")))
+	assert.Equal(t, "ab", buffer.String())
+}
+
+func TestHTTPSink(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+
+		if r.Method != http.MethodPost || r.URL.Path != "/reload" {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	assert.Nil(t, (&HTTPSink{URL: server.URL + "/reload"}).Write([]byte("config")))
+	assert.Equal(t, "config", received)
+
+	assert.NotNil(t, (&HTTPSink{URL: server.URL + "/missing"}).Write([]byte("config")))
+}
@@ -0,0 +1,318 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Status tracks the runtime state of redis-template. It is used to answer liveness and readiness probes. A nil *Status
+// tracks nothing.
+type Status struct {
+	mut sync.Mutex
+
+	// threshold is how long the pubsub connection can go without being confirmed alive before it is unhealthy.
+	threshold time.Duration
+
+	// readyFile, if set, is written once every template has rendered.
+	readyFile string
+
+	// pubsubSeen is the last time the pubsub connection was confirmed to be alive. It is zero while disconnected.
+	pubsubSeen time.Time
+
+	// templates are the templates being processed, by name.
+	templates map[string]*templateRecord
+}
+
+// templateRecord is the state of a template tracked by a Status.
+type templateRecord struct {
+	template Template
+	status   TemplateStatus
+}
+
+// TemplateStatus describes the state of a template.
+type TemplateStatus struct {
+	Name           string         `json:"name"`
+	Target         string         `json:"target,omitempty"`
+	LastRender     *time.Time     `json:"last_render,omitempty"`
+	LastOutputHash string         `json:"last_output_hash,omitempty"`
+	LastError      string         `json:"last_error,omitempty"`
+	Dependencies   []string       `json:"dependencies"`
+	LastCommand    *CommandStatus `json:"last_command,omitempty"`
+}
+
+// CommandStatus describes the last run of a template's command.
+type CommandStatus struct {
+	Time     time.Time `json:"time"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// NewStatus creates a Status. The pubsub connection is considered healthy if it has been confirmed alive within the
+// threshold. If readyFile is set it is written once every template has rendered successfully, for environments that
+// can't probe over http.
+func NewStatus(threshold time.Duration, readyFile string) *Status {
+	return &Status{
+		threshold: threshold,
+		readyFile: readyFile,
+		templates: map[string]*templateRecord{},
+	}
+}
+
+// minPingInterval is the shortest interval the pubsub connection is pinged at.
+const minPingInterval = time.Second
+
+// pingInterval is how often the pubsub connection should be pinged to confirm that it is alive.
+func (s *Status) pingInterval() time.Duration {
+	if s.threshold/3 < minPingInterval {
+		return minPingInterval
+	}
+
+	return s.threshold / 3
+}
+
+// pubsubAlive records that the pubsub connection is alive.
+func (s *Status) pubsubAlive() {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.pubsubSeen = time.Now()
+}
+
+// pubsubDown records that the pubsub connection has failed.
+func (s *Status) pubsubDown() {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.pubsubSeen = time.Time{}
+}
+
+// setTemplates sets the templates that must render before redis-template is ready. The state of templates that were
+// already being tracked is kept.
+func (s *Status) setTemplates(templates []Template) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	records := make(map[string]*templateRecord, len(templates))
+	for _, template := range templates {
+		name := template.SourceTemplate.Name()
+		record, ok := s.templates[name]
+		if !ok {
+			record = &templateRecord{status: TemplateStatus{Name: name}}
+		}
+
+		record.template = template
+		if template.Target != nil {
+			record.status.Target = *template.Target
+		}
+
+		records[name] = record
+	}
+
+	s.templates = records
+	return s.updateReadyFile()
+}
+
+// templateRendered records that the template has rendered successfully, producing the given output.
+func (s *Status) templateRendered(name string, output []byte) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	record, ok := s.templates[name]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	wasRendered := record.status.LastRender != nil
+	record.status.LastRender = &now
+	record.status.LastOutputHash = fmt.Sprintf("%x", sha256.Sum256(output))
+	record.status.LastError = ""
+
+	if wasRendered {
+		return nil
+	}
+
+	return s.updateReadyFile()
+}
+
+// renderFailed records that the template failed to render.
+func (s *Status) renderFailed(name string, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if record, ok := s.templates[name]; ok {
+		record.status.LastError = err.Error()
+	}
+}
+
+// commandCompleted records a run of the template's command.
+func (s *Status) commandCompleted(name string, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	record, ok := s.templates[name]
+	if !ok {
+		return
+	}
+
+	record.status.LastCommand = &CommandStatus{
+		Time:     time.Now(),
+		ExitCode: exitCode(err),
+	}
+
+	if err != nil {
+		record.status.LastCommand.Error = err.Error()
+	}
+}
+
+// Templates returns the status of every template, sorted by name.
+func (s *Status) Templates() []TemplateStatus {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	statuses := make([]TemplateStatus, 0, len(s.templates))
+	for _, record := range s.templates {
+		status := record.status
+		status.Dependencies = record.template.state.getDependencies()
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// template returns the template with the given name. Names are compared as cleaned paths without a leading "/", so
+// that they can be given in url paths.
+func (s *Status) template(name string) (Template, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for n, record := range s.templates {
+		if trimPath(n) == trimPath(name) {
+			return record.template, true
+		}
+	}
+
+	return Template{}, false
+}
+
+// trimPath cleans the path and removes any leading "/".
+func trimPath(p string) string {
+	return strings.TrimPrefix(path.Clean(p), "/")
+}
+
+// updateReadyFile writes the ready file if every template has rendered, and removes it otherwise. It must be called
+// with the lock held.
+func (s *Status) updateReadyFile() error {
+	if s.readyFile == "" {
+		return nil
+	}
+
+	if s.pending() == nil {
+		return errors.WithStack(ioutil.WriteFile(s.readyFile, []byte(time.Now().Format(time.RFC3339)), 0644))
+	}
+
+	if err := os.Remove(s.readyFile); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// pending returns the names of the templates that haven't rendered yet. It must be called with the lock held.
+func (s *Status) pending() []string {
+	var pending []string
+	for name, record := range s.templates {
+		if record.status.LastRender == nil {
+			pending = append(pending, name)
+		}
+	}
+
+	sort.Strings(pending)
+	return pending
+}
+
+// Healthy returns an error if the pubsub connection hasn't been confirmed alive within the threshold.
+func (s *Status) Healthy() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.pubsubSeen.IsZero() {
+		return errors.New("not subscribed to redis")
+	}
+
+	if since := time.Since(s.pubsubSeen); since > s.threshold {
+		return fmt.Errorf("pubsub connection not seen alive for %s", since)
+	}
+
+	return nil
+}
+
+// Ready returns an error if any of the templates haven't rendered successfully yet.
+func (s *Status) Ready() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if pending := s.pending(); len(pending) > 0 {
+		return fmt.Errorf("templates not rendered: %s", strings.Join(pending, ", "))
+	}
+
+	return nil
+}
+
+// HealthHandler returns an http.Handler that responds with 200 when Healthy, and 503 otherwise.
+func (s *Status) HealthHandler() http.Handler {
+	return probeHandler(s.Healthy)
+}
+
+// ReadyHandler returns an http.Handler that responds with 200 when Ready, and 503 otherwise.
+func (s *Status) ReadyHandler() http.Handler {
+	return probeHandler(s.Ready)
+}
+
+// probeHandler returns an http.Handler that responds with 200 if the check passes, and 503 with the error otherwise.
+func probeHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
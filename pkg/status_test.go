@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus_Healthy(t *testing.T) {
+	status := NewStatus(time.Minute, "")
+	assert.NotNil(t, status.Healthy())
+
+	status.pubsubAlive()
+	assert.Nil(t, status.Healthy())
+
+	status.pubsubSeen = time.Now().Add(-2 * time.Minute)
+	assert.NotNil(t, status.Healthy())
+
+	status.pubsubAlive()
+	status.pubsubDown()
+	assert.NotNil(t, status.Healthy())
+}
+
+func TestStatus_Ready(t *testing.T) {
+	const ReadyFile = "./test_files/ready"
+	os.Remove(ReadyFile)
+
+	status := NewStatus(time.Minute, ReadyFile)
+	templates := []Template{
+		{SourceTemplate: template.New("foo.tmpl")},
+		{SourceTemplate: template.New("bar.tmpl")},
+	}
+
+	if err := status.setTemplates(templates); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, status.Ready())
+
+	recorder := httptest.NewRecorder()
+	status.ReadyHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	if err := status.templateRendered("foo.tmpl", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, status.Ready())
+	_, err := ioutil.ReadFile(ReadyFile)
+	assert.True(t, os.IsNotExist(err))
+
+	if err := status.templateRendered("bar.tmpl", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, status.Ready())
+	_, err = ioutil.ReadFile(ReadyFile)
+	assert.Nil(t, err)
+
+	recorder = httptest.NewRecorder()
+	status.ReadyHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestStatus_Templates(t *testing.T) {
+	status := NewStatus(time.Minute, "")
+
+	target := "/app/foo.json"
+	err := status.setTemplates([]Template{
+		{SourceTemplate: template.New("/app/foo.json.tmpl"), Target: &target, state: &templateState{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := status.templateRendered("/app/foo.json.tmpl", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	status.commandCompleted("/app/foo.json.tmpl", nil)
+
+	statuses := status.Templates()
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "/app/foo.json.tmpl", statuses[0].Name)
+		assert.Equal(t, "/app/foo.json", statuses[0].Target)
+		assert.Equal(t, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", statuses[0].LastOutputHash)
+		assert.NotNil(t, statuses[0].LastRender)
+		if assert.NotNil(t, statuses[0].LastCommand) {
+			assert.Equal(t, 0, statuses[0].LastCommand.ExitCode)
+		}
+	}
+
+	_, ok := status.template("app/foo.json.tmpl")
+	assert.True(t, ok)
+	_, ok = status.template("app/bar.json.tmpl")
+	assert.False(t, ok)
+}
@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// The types of the values of keys.
+const (
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+)
+
+// Value is the value of a key, of any of the types that can be imported and exported.
+type Value struct {
+	Type string
+
+	// String is the value of a string.
+	String string
+
+	// Fields are the fields of a hash.
+	Fields map[string]string
+
+	// Members are the items of a list, in order, or the members of a set.
+	Members []string
+
+	// Scores are the members of a sorted set, and their scores.
+	Scores map[string]float64
+}
+
+// StringValue returns a string value.
+func StringValue(s string) *Value {
+	return &Value{Type: TypeString, String: s}
+}
+
+// equal reports whether the two values are the same. The order of the members of sets doesn't matter.
+func (v Value) equal(other Value) bool {
+	if v.Type == TypeSet {
+		v.Members, other.Members = sortedCopy(v.Members), sortedCopy(other.Members)
+	}
+
+	a, _ := json.Marshal(v.document())
+	b, _ := json.Marshal(other.document())
+	return string(a) == string(b)
+}
+
+// sortedCopy returns a sorted copy of the strings.
+func sortedCopy(values []string) []string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// document returns the value as it is written in an exported document. Strings are written as is, other types are
+// written as an object giving their $type and $value.
+func (v Value) document() interface{} {
+	var value interface{}
+	switch v.Type {
+	case TypeString:
+		return v.String
+	case TypeHash:
+		value = v.Fields
+		if v.Fields == nil {
+			value = map[string]string{}
+		}
+	case TypeList:
+		value = append([]string{}, v.Members...)
+	case TypeSet:
+		value = sortedCopy(v.Members)
+	case TypeZSet:
+		scores := make(map[string]interface{}, len(v.Scores))
+		for member, score := range v.Scores {
+			scores[member] = json.Number(strconv.FormatFloat(score, 'g', -1, 64))
+		}
+
+		value = scores
+	}
+
+	return map[string]interface{}{"$type": v.Type, "$value": value}
+}
+
+// typedDocument returns the type and value of a document written by document, if it is one.
+func typedDocument(document interface{}) (string, interface{}, bool) {
+	object, ok := document.(map[string]interface{})
+	if !ok || len(object) != 2 {
+		return "", nil, false
+	}
+
+	valueType, ok := object["$type"].(string)
+	if !ok {
+		return "", nil, false
+	}
+
+	value, ok := object["$value"]
+	return valueType, value, ok
+}
+
+// parseTypedDocument parses a document written by document for a type other than string.
+func parseTypedDocument(valueType string, document interface{}) (Value, error) {
+	value := Value{Type: valueType}
+	switch valueType {
+	case TypeHash:
+		fields, ok := document.(map[string]interface{})
+		if !ok {
+			return Value{}, errors.New("the $value of a hash must be an object")
+		}
+
+		value.Fields = make(map[string]string, len(fields))
+		for field, v := range fields {
+			value.Fields[field] = scalarText(v)
+		}
+	case TypeList, TypeSet:
+		members, ok := document.([]interface{})
+		if !ok {
+			return Value{}, errors.Errorf("the $value of a %s must be an array", valueType)
+		}
+
+		value.Members = make([]string, len(members))
+		for i, member := range members {
+			value.Members[i] = scalarText(member)
+		}
+	case TypeZSet:
+		scores, ok := document.(map[string]interface{})
+		if !ok {
+			return Value{}, errors.New("the $value of a zset must be an object of members and scores")
+		}
+
+		value.Scores = make(map[string]float64, len(scores))
+		for member, score := range scores {
+			parsed, err := strconv.ParseFloat(scalarText(score), 64)
+			if err != nil {
+				return Value{}, errors.Errorf("invalid score for member %s", member)
+			}
+
+			value.Scores[member] = parsed
+		}
+	default:
+		return Value{}, errors.Errorf("unknown $type %s", valueType)
+	}
+
+	return value, nil
+}
+
+// scalarText returns the text of a scalar parsed from a document, as it is stored in redis.
+func scalarText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number, bool:
+		return fmt.Sprint(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// readValue reads the value of the key. It returns nil if the key doesn't exist.
+func readValue(c redis.Conn, key string) (*Value, error) {
+	valueType, err := redis.String(c.Do("TYPE", key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the type of key %s", key)
+	}
+
+	return readTypedValue(c, key, valueType)
+}
+
+// readTypedValue reads the value of the key, which has the given type.
+func readTypedValue(c redis.Conn, key string, valueType string) (*Value, error) {
+	var err error
+	value := &Value{Type: valueType}
+	switch valueType {
+	case "none":
+		return nil, nil
+	case TypeString:
+		value.String, err = redis.String(c.Do("GET", key))
+	case TypeHash:
+		value.Fields, err = redis.StringMap(c.Do("HGETALL", key))
+	case TypeList:
+		value.Members, err = redis.Strings(c.Do("LRANGE", key, 0, -1))
+	case TypeSet:
+		value.Members, err = redis.Strings(c.Do("SMEMBERS", key))
+		sort.Strings(value.Members)
+	case TypeZSet:
+		var reply []string
+		reply, err = redis.Strings(c.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+		value.Scores = make(map[string]float64, len(reply)/2)
+		for i := 0; err == nil && i+1 < len(reply); i += 2 {
+			value.Scores[reply[i]], err = strconv.ParseFloat(reply[i+1], 64)
+		}
+	default:
+		return nil, errors.Errorf("key %s has unsupported type %s", key, valueType)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read key %s", key)
+	}
+
+	return value, nil
+}
+
+// send queues the commands replacing the key with the value.
+func (v Value) send(c redis.Conn, key string) error {
+	if v.Type == TypeString {
+		return c.Send("SET", key, v.String)
+	}
+
+	if err := c.Send("DEL", key); err != nil {
+		return err
+	}
+
+	switch {
+	case v.Type == TypeHash && len(v.Fields) > 0:
+		return c.Send("HSET", redis.Args{key}.AddFlat(v.Fields)...)
+	case v.Type == TypeList && len(v.Members) > 0:
+		return c.Send("RPUSH", redis.Args{key}.AddFlat(v.Members)...)
+	case v.Type == TypeSet && len(v.Members) > 0:
+		return c.Send("SADD", redis.Args{key}.AddFlat(v.Members)...)
+	case v.Type == TypeZSet && len(v.Scores) > 0:
+		args := redis.Args{key}
+		for member, score := range v.Scores {
+			args = args.Add(score, member)
+		}
+
+		return c.Send("ZADD", args...)
+	}
+
+	return nil
+}
+
+// describe returns a short description of the value, e.g. "10.0.0.2" or hash(3).
+func (v Value) describe() string {
+	switch v.Type {
+	case TypeString:
+		return strconv.Quote(v.String)
+	case TypeHash:
+		return fmt.Sprintf("hash(%d)", len(v.Fields))
+	case TypeZSet:
+		return fmt.Sprintf("zset(%d)", len(v.Scores))
+	default:
+		return fmt.Sprintf("%s(%d)", v.Type, len(v.Members))
+	}
+}
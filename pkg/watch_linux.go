@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package pkg
+
+import (
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// watchEvents are the inotify events that are treated as a file changing. Editors either write files in place, or
+// write a new file and rename it over the original.
+const watchEvents = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE
+
+// fileWatcher watches files for changes using inotify. The directories containing the files are watched, rather than
+// the files themselves, so that files replaced by a rename are still noticed.
+type fileWatcher struct {
+	fd int
+
+	mut sync.Mutex
+
+	// dirs are the watched directories, by their watch descriptors.
+	dirs map[int]string
+
+	// files are the paths of the files being watched.
+	files map[string]bool
+}
+
+// newFileWatcher creates a fileWatcher that isn't watching any files.
+func newFileWatcher() (*fileWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize inotify")
+	}
+
+	return &fileWatcher{
+		fd:    fd,
+		dirs:  map[int]string{},
+		files: map[string]bool{},
+	}, nil
+}
+
+// watch starts watching the given files. Files that are already being watched are ignored.
+func (w *fileWatcher) watch(paths ...string) error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if w.files[abs] {
+			continue
+		}
+
+		wd, err := unix.InotifyAddWatch(w.fd, filepath.Dir(abs), watchEvents)
+		if err != nil {
+			return errors.Wrapf(err, "failed to watch %s", path)
+		}
+
+		w.dirs[wd] = filepath.Dir(abs)
+		w.files[abs] = true
+	}
+
+	return nil
+}
+
+// run reads inotify events, sending the absolute path of any watched file that changes to changed. It only returns
+// if reading the events fails.
+func (w *fileWatcher) run(changed chan<- string) error {
+	buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(w.fd, buffer)
+		if err != nil {
+			return errors.Wrap(err, "failed to read inotify events")
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			// the name is padded with null bytes.
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			w.mut.Lock()
+			path := filepath.Join(w.dirs[int(event.Wd)], name)
+			watched := w.files[path]
+			w.mut.Unlock()
+
+			if watched {
+				changed <- path
+			}
+		}
+	}
+}
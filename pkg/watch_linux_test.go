@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileWatcher(t *testing.T) {
+	const TestTemplate = "./test_files/watched.tmpl"
+
+	if err := ioutil.WriteFile(TestTemplate, []byte(`{{key "foo"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := newFileWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := watcher.watch(TestTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan string, 10)
+	go watcher.run(changed)
+
+	// files that aren't watched are ignored.
+	if err := ioutil.WriteFile("./test_files/unwatched.tmpl", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// editors often write a new file and rename it over the original.
+	if err := ioutil.WriteFile(TestTemplate+".swp", []byte(`{{key "bar"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(TestTemplate+".swp", TestTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := filepath.Abs(TestTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case path := <-changed:
+		assert.Equal(t, expected, path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change wasn't noticed")
+	}
+}
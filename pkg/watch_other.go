@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package pkg
+
+import (
+	"github.com/pkg/errors"
+)
+
+// fileWatcher watches files for changes. It is only supported on linux.
+type fileWatcher struct{}
+
+// newFileWatcher returns an error, as watching files is only supported on linux.
+func newFileWatcher() (*fileWatcher, error) {
+	return nil, errors.New("watching templates is only supported on linux")
+}
+
+// watch does nothing.
+func (w *fileWatcher) watch(paths ...string) error {
+	return nil
+}
+
+// run does nothing.
+func (w *fileWatcher) run(changed chan<- string) error {
+	return nil
+}